@@ -6,8 +6,9 @@ import (
 )
 
 type IProducts interface {
-	New(userID string, name string, cost wallets.Amount) (IProduct, error)
-	DelID(id string)
+	New(userID string, name string, cost wallets.Money) (IProduct, error)
+	//DelID removes the goods and returns true if it existed
+	DelID(id string) bool
 	GetID(goodsID string) IProduct
 	UserGoods(userID string) (map[string]IProduct, bool)
 }
@@ -16,5 +17,5 @@ type IProduct interface {
 	ID() string
 	Owner() users.IUser //=owner of the goods, who gets the money when bought
 	Name() string       //name of goods
-	Cost() wallets.Amount
+	Cost() wallets.Money
 }
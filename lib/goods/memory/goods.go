@@ -10,6 +10,12 @@ import (
 	"github.com/satori/uuid"
 )
 
+func init() {
+	goods.Register("memory", func(mongoURI string, dbName string, users users.IUsers) (goods.IProducts, error) {
+		return New(users)
+	})
+}
+
 func New(users users.IUsers) (goods.IProducts, error) {
 	return &factory{
 		users:    users,
@@ -25,7 +31,7 @@ type factory struct {
 	byUserID map[string]map[string]goods.IProduct
 }
 
-func (f *factory) New(userID string, goodsName string, cost wallets.Amount) (goods.IProduct, error) {
+func (f *factory) New(userID string, goodsName string, cost wallets.Money) (goods.IProduct, error) {
 	if f == nil {
 		panic("nil.New()")
 	}
@@ -33,10 +39,13 @@ func (f *factory) New(userID string, goodsName string, cost wallets.Amount) (goo
 	if len(goodsName) < 1 {
 		return nil, log.Wrapf(nil, "goods.name is required")
 	}
-	if cost <= 0 {
-		return nil, log.Wrapf(nil, "goods.cost=%d must be >0", cost)
+	if !cost.IsPositive() {
+		return nil, log.Wrapf(nil, "goods.cost=%s must be >0", cost)
+	}
+	u, err := f.users.GetID(userID)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot get user")
 	}
-	u := f.users.GetID(userID)
 	if u == nil {
 		return nil, log.Wrapf(nil, "unknown user id")
 	}
@@ -59,10 +68,10 @@ func (f *factory) New(userID string, goodsName string, cost wallets.Amount) (goo
 	if _, ok := f.byID[g.id]; ok {
 		return nil, log.Wrapf(nil, "duplicate goods.id=%s created", g.id)
 	}
-	if _, ok := f.byUserID[g.id]; !ok {
-		f.byUserID[g.id] = make(map[string]goods.IProduct)
+	if _, ok := f.byUserID[userID]; !ok {
+		f.byUserID[userID] = make(map[string]goods.IProduct)
 	}
-	f.byUserID[g.id][goodsName] = g
+	f.byUserID[userID][goodsName] = g
 	f.byID[g.id] = g
 	return g, nil
 } //factory.New()
@@ -71,7 +80,15 @@ func (f *factory) UserGoods(userID string) (map[string]goods.IProduct, bool) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	ug, ok := f.byUserID[userID]
-	return ug, ok
+	if !ok {
+		return nil, false
+	}
+	//return a copy so callers can range over it without the lock
+	list := make(map[string]goods.IProduct, len(ug))
+	for name, g := range ug {
+		list[name] = g
+	}
+	return list, true
 } //factory.UserGoods()
 
 func (f *factory) GetID(goodsID string) goods.IProduct {
@@ -80,7 +97,7 @@ func (f *factory) GetID(goodsID string) goods.IProduct {
 	return f.byID[goodsID]
 } //factory.GetID()
 
-func (f *factory) DelID(goodsID string) {
+func (f *factory) DelID(goodsID string) bool {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
@@ -97,9 +114,10 @@ func (f *factory) DelID(goodsID string) {
 		}
 		delete(f.byID, goodsID)
 		log.Debugf("Deleted goods.id=%s", goodsID)
-	} else {
-		log.Debugf("Delete goods.id=%s not found", goodsID)
+		return true
 	}
+	log.Debugf("Delete goods.id=%s not found", goodsID)
+	return false
 } //factory.DelID()
 
 //memoryGoods implements IProduct
@@ -107,7 +125,7 @@ type memoryGoods struct {
 	id   string
 	user users.IUser
 	name string
-	cost wallets.Amount
+	cost wallets.Money
 }
 
 func (s memoryGoods) ID() string {
@@ -122,6 +140,6 @@ func (s memoryGoods) Name() string {
 	return s.name
 }
 
-func (s memoryGoods) Cost() wallets.Amount {
+func (s memoryGoods) Cost() wallets.Money {
 	return s.cost
 }
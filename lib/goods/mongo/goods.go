@@ -14,6 +14,10 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func init() {
+	goods.Register("mongo", Products)
+}
+
 //e.g. Products("mongodb://localhost:27017", "taxiching")
 func Products(mongoURI string, dbName string, users users.IUsers) (goods.IProducts, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
@@ -35,22 +39,34 @@ func Products(mongoURI string, dbName string, users users.IUsers) (goods.IProduc
 	// }
 
 	collection := client.Database(dbName).Collection("products")
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}); err != nil {
+		return nil, log.Wrapf(err, "Failed to create product indexes")
+	}
+
 	return &factory{
 		users:      users,
 		collection: collection,
 	}, nil
 } //Products()
 
-func (f *factory) UserGoods(userID string) (map[string]goods.IProduct, bool) {
-	return nil, true //todo
-} //factory.UserGoods()
+//productDoc is the stored form of a product
+type productDoc struct {
+	ID       string `bson:"id"`
+	Owner    string `bson:"owner"`
+	Name     string `bson:"name"`
+	Currency string `bson:"currency"`
+	Cost     int64  `bson:"cost"` //minor units of currency, int32 in old records decodes fine
+}
 
-//mongoProduct implements IUser
+//mongoProduct implements IProduct
 type mongoProduct struct {
 	id    string
 	owner users.IUser
 	name  string
-	cost  wallets.Amount
+	cost  wallets.Money
 }
 
 func (u mongoProduct) ID() string {
@@ -65,7 +81,7 @@ func (u mongoProduct) Name() string {
 	return u.name
 }
 
-func (u mongoProduct) Cost() wallets.Amount {
+func (u mongoProduct) Cost() wallets.Money {
 	return u.cost
 }
 
@@ -74,11 +90,17 @@ type factory struct {
 	collection *mongo.Collection
 }
 
-func (f factory) New(userID string, name string, cost wallets.Amount) (goods.IProduct, error) {
+func (f factory) New(userID string, name string, cost wallets.Money) (goods.IProduct, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	u := f.users.GetID(userID)
+	if len(name) < 1 {
+		return nil, log.Wrapf(nil, "goods.name is required")
+	}
+	u, err := f.users.GetID(userID)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot get user")
+	}
 	if u == nil {
 		return nil, log.Wrapf(nil, "unknown user id")
 	}
@@ -87,21 +109,23 @@ func (f factory) New(userID string, name string, cost wallets.Amount) (goods.IPr
 		return nil, log.Wrapf(nil, "User(%s).Product(%s) already exists", userID, name)
 	}
 
-	id := uuid.NewV1().String()
-	_, err := f.collection.InsertOne(
-		ctx,
-		bson.M{
-			"id":    id,
-			"owner": userID,
-			"name":  name,
-			"cost":  cost,
-		})
-	if err != nil {
+	if !cost.IsPositive() {
+		return nil, log.Wrapf(nil, "goods.cost=%s must be >0", cost)
+	}
+
+	doc := productDoc{
+		ID:       uuid.NewV1().String(),
+		Owner:    userID,
+		Name:     name,
+		Currency: string(cost.Currency),
+		Cost:     cost.Units,
+	}
+	if _, err := f.collection.InsertOne(ctx, doc); err != nil {
 		return nil, log.Wrapf(err, "failed to insert product into db")
 	}
 
 	p := &mongoProduct{
-		id:    id,
+		id:    doc.ID,
 		owner: u,
 		name:  name,
 		cost:  cost,
@@ -109,93 +133,112 @@ func (f factory) New(userID string, name string, cost wallets.Amount) (goods.IPr
 	return p, nil
 } //factory.New()
 
-func (f factory) GetUserProduct(user users.IUser, productName string) goods.IProduct {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+func (f *factory) UserGoods(userID string) (map[string]goods.IProduct, bool) {
+	u, err := f.users.GetID(userID)
+	if err != nil {
+		log.Errorf("Failed to get user.id=%s: %v", userID, err)
+		return nil, false
+	}
+	if u == nil {
+		return nil, false
+	}
+	list, err := f.find(bson.M{"owner": userID}, u)
+	if err != nil {
+		log.Errorf("Failed to get user.id=%s goods: %v", userID, err)
+		return nil, false
+	}
+	if len(list) == 0 {
+		return nil, false
+	}
+	ug := make(map[string]goods.IProduct, len(list))
+	for _, p := range list {
+		ug[p.Name()] = p
+	}
+	return ug, true
+} //factory.UserGoods()
 
-	cur, err := f.collection.Find(ctx, bson.M{"owner": user.ID(), "name": productName})
+func (f factory) GetUserProduct(user users.IUser, productName string) goods.IProduct {
+	list, err := f.find(bson.M{"owner": user.ID(), "name": productName}, user)
 	if err != nil {
 		log.Errorf("Failed to find user product: %v", err)
 		return nil
 	}
-	defer cur.Close(ctx)
-
-	for cur.Next(ctx) {
-		var result bson.M
-		err := cur.Decode(&result)
-		if err != nil {
-			log.Errorf("Failed to get data: %v", err)
-			return nil
-		}
-		// do something with result....
-		log.Debugf("GOT (%T): %+v", result, result)
-
-		p := mongoProduct{
-			id:    result["id"].(string),
-			owner: user,
-			name:  result["name"].(string),
-			cost:  wallets.Amount(result["cost"].(int32)),
-		}
-		return &p
-	}
-
-	if err := cur.Err(); err != nil {
-		log.Errorf("Error: %v", err)
+	if len(list) == 0 {
 		return nil
 	}
-	return nil
+	return list[0]
 } //factory.GetUserProduct()
 
 func (f factory) GetID(id string) goods.IProduct {
+	list, err := f.find(bson.M{"id": id}, nil)
+	if err != nil {
+		log.Errorf("Failed to find id: %v", err)
+		return nil
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+} //factory.GetID()
+
+//find returns the products matching the filter
+//owner is used when known, else each owner is looked up
+func (f factory) find(filter bson.M, owner users.IUser) ([]goods.IProduct, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cur, err := f.collection.Find(ctx, bson.M{"id": id})
+	cur, err := f.collection.Find(ctx, filter)
 	if err != nil {
-		log.Errorf("Failed to find id: %v", err)
-		return nil
+		return nil, log.Wrapf(err, "failed to find products")
 	}
 	defer cur.Close(ctx)
 
+	list := []goods.IProduct{}
 	for cur.Next(ctx) {
-		var result bson.M
-		err := cur.Decode(&result)
-		if err != nil {
-			log.Errorf("Failed to get data: %v", err)
-			return nil
+		var doc productDoc
+		if err := cur.Decode(&doc); err != nil {
+			return nil, log.Wrapf(err, "failed to decode product")
 		}
-		// do something with result....
-		log.Debugf("GOT (%T): %+v", result, result)
-
-		userID := result["owner"].(string)
-		user := f.users.GetID(userID)
-		if user == nil {
-			log.Errorf("Failed to get user from id=%s", result["owner"].(string))
-			return nil
+		log.Debugf("GOT: %+v", doc)
+
+		u := owner
+		if u == nil {
+			var err error
+			if u, err = f.users.GetID(doc.Owner); u == nil {
+				log.Errorf("Failed to get user from id=%s for product.id=%s: %v", doc.Owner, doc.ID, err)
+				continue
+			}
 		}
-
-		p := mongoProduct{
-			id:    result["id"].(string),
-			owner: user,
-			name:  result["name"].(string),
-			cost:  wallets.Amount(result["cost"].(int32)),
+		currency := wallets.Currency(doc.Currency)
+		if len(currency) == 0 {
+			currency = wallets.DefaultCurrency
 		}
-		return &p
+		list = append(list, &mongoProduct{
+			id:    doc.ID,
+			owner: u,
+			name:  doc.Name,
+			cost:  wallets.NewMoney(currency, doc.Cost),
+		})
 	}
-
 	if err := cur.Err(); err != nil {
-		log.Errorf("Error: %v", err)
-		return nil
+		return nil, log.Wrapf(err, "failed to read products")
 	}
-	return nil
-} //factory.GetID()
+	return list, nil
+} //factory.find()
 
-func (f *factory) DelID(id string) {
+func (f *factory) DelID(id string) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	err := f.collection.FindOneAndDelete(ctx, bson.M{"id": id})
+	res, err := f.collection.DeleteOne(ctx, bson.M{"id": id})
 	if err != nil {
-		log.Errorf("Failed to delete id: %v", err)
+		log.Errorf("Failed to delete goods.id=%s: %v", id, err)
+		return false
 	}
-}
+	if res.DeletedCount == 0 {
+		log.Debugf("Delete goods.id=%s not found", id)
+		return false
+	}
+	log.Debugf("Deleted goods.id=%s", id)
+	return true
+} //factory.DelID()
@@ -0,0 +1,25 @@
+package goods
+
+import (
+	"github.com/jansemmelink/taxiching/lib/registry"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+//Backend opens the products of the users in a store
+type Backend func(mongoURI string, dbName string, users users.IUsers) (IProducts, error)
+
+var backends = registry.New("goods")
+
+//Register makes the goods backend available by name
+func Register(name string, b Backend) {
+	backends.Add(name, b)
+} //Register()
+
+//Open goods with the named backend
+func Open(name string, mongoURI string, dbName string, users users.IUsers) (IProducts, error) {
+	b, err := backends.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Backend)(mongoURI, dbName, users)
+} //Open()
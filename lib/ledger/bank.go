@@ -3,13 +3,9 @@ package ledger
 import (
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/goods"
-	mongogoods "github.com/jansemmelink/taxiching/lib/goods/mongo"
 	"github.com/jansemmelink/taxiching/lib/sessions"
-	memorysessions "github.com/jansemmelink/taxiching/lib/sessions/memory"
 	"github.com/jansemmelink/taxiching/lib/users"
-	mongousers "github.com/jansemmelink/taxiching/lib/users/mongo"
 	"github.com/jansemmelink/taxiching/lib/wallets"
-	mongowallets "github.com/jansemmelink/taxiching/lib/wallets/mongo"
 )
 
 type Bank struct {
@@ -22,43 +18,89 @@ type Bank struct {
 	Goods goods.IProducts
 
 	Sessions sessions.ISessions
+
+	Transactions ITransactionStore
 }
 
-func New(mongoURI string) *Bank {
-	var err error
+//New opens the bank with the backends in the config, which must be
+//registered, e.g. by importing the backend packages in main
+//the bank wallet belongs to the admin in the config, see Setup()
+func New(config Config) *Bank {
+	config, err := config.Validate()
+	if err != nil {
+		panic(log.Wrapf(err, "invalid bank config"))
+	}
+	mongoURI, dbName := config.MongoURI, config.DBName
 	b := &Bank{}
 
-	//users database
-	b.Users, err = mongousers.Users(mongoURI, "taxiching")
+	b.Users, err = users.Open(config.Backends.Users, mongoURI, dbName)
 	if err != nil {
 		panic(log.Wrapf(err, "failed to create users"))
 	}
 
-	b.adminUser = b.Users.GetMsisdn("27824526299")
-	if b.adminUser == nil {
-		b.adminUser, err = b.Users.New("27824526299", "Jan", "1155")
-		if err != nil {
-			panic("Failed to create admin user: " + err.Error())
-		}
-	}
-
-	b.Wallets, err = mongowallets.Wallets(mongoURI, "taxiching", b.Users)
+	b.Wallets, err = wallets.Open(config.Backends.Wallets, mongoURI, dbName, b.Users)
 	if err != nil {
 		panic(log.Wrapf(err, "failed to create wallets"))
 	}
 
-	b.BankWallet, err = b.Wallets.New(b.adminUser, "bank", -10000000)
+	if b.adminUser, err = b.Users.GetMsisdn(config.AdminMsisdn); err != nil {
+		panic(log.Wrapf(err, "failed to get admin user"))
+	}
+	if b.adminUser != nil {
+		b.BankWallet = b.Wallets.UserWallet(b.adminUser.ID(), "bank")
+	}
+	if b.BankWallet == nil {
+		log.Errorf("No bank wallet for admin msisdn=%s, deposits fail until setup is done", config.AdminMsisdn)
+	}
+
+	b.Transactions, err = openJournal(config.Backends.Wallets, mongoURI, dbName, b.Wallets)
 	if err != nil {
-		panic("Failed to create bank wallet: " + err.Error())
+		panic(log.Wrapf(err, "failed to create transactions"))
 	}
 
-	b.Goods, err = mongogoods.Products(mongoURI, "taxiching", b.Users)
+	b.Goods, err = goods.Open(config.Backends.Goods, mongoURI, dbName, b.Users)
+	if err != nil {
+		panic(log.Wrapf(err, "failed to create goods"))
+	}
 
-	b.Sessions, err = memorysessions.New(b.Users)
+	b.Sessions, err = sessions.Open(config.Backends.Sessions, mongoURI, dbName, b.Users, config.Sessions)
 	if err != nil {
-		panic("Failed to create bank wallet: " + err.Error())
+		panic(log.Wrapf(err, "failed to create sessions"))
 	}
 
 	log.Debugf("Created bank account")
 	return b
-}
+} //New()
+
+//Setup is done once to create the admin user and the bank wallet, which
+//may go down to minBalance, and the FX wallets in fxMinBalances
+//if a user with the msisdn already exists, it is given the admin role
+//and keeps its password, so it is also done again to add FX currencies
+func (b *Bank) Setup(adminMsisdn, name, password string, minBalance wallets.Money, fxMinBalances []wallets.Money) error {
+	u, err := b.Users.GetMsisdn(adminMsisdn)
+	if err != nil {
+		return log.Wrapf(err, "failed to get admin user")
+	}
+	if u == nil {
+		if u, err = b.Users.New(adminMsisdn, name, password); err != nil {
+			return log.Wrapf(err, "failed to create admin user")
+		}
+	}
+	if !users.HasRole(u, users.RoleAdmin) {
+		if err := u.SetRoles(append(u.Roles(), users.RoleAdmin)...); err != nil {
+			return log.Wrapf(err, "failed to make user.id=%s admin", u.ID())
+		}
+	}
+	b.adminUser = u
+
+	if b.BankWallet = b.Wallets.UserWallet(u.ID(), "bank"); b.BankWallet == nil {
+		if b.BankWallet, err = b.Wallets.New(u, "bank", minBalance); err != nil {
+			return log.Wrapf(err, "failed to create bank wallet")
+		}
+	}
+	if err := b.setupFX(fxMinBalances); err != nil {
+		return err
+	}
+	log.Debugf("Setup admin user.id=%s with bank wallet.id=%s", u.ID(), b.BankWallet.ID())
+	return nil
+} //Bank.Setup()
@@ -0,0 +1,105 @@
+package ledger
+
+import (
+	"regexp"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//Config of the bank, start from DefaultConfig()
+type Config struct {
+	MongoURI string
+	//DBName is the mongo database with all the collections
+	DBName string
+	//AdminMsisdn is the admin user who owns the bank wallet, see Setup()
+	AdminMsisdn string
+	//BankMinBalance is how far the bank wallet may go negative, as it is
+	//debited with the EFT deposits loaded into user wallets
+	BankMinBalance wallets.Money
+	//FXMinBalances is how far the bank FX wallet of each currency may go
+	//negative, conversions are only done between these currencies
+	FXMinBalances []wallets.Money
+	Sessions      sessions.Options
+	Backends      Backends
+}
+
+//Backends name the implementation of each store, as registered in the
+//users, wallets, goods and sessions packages
+//the transactions are kept with the wallets, as postings update both,
+//see RegisterJournal
+type Backends struct {
+	Users    string
+	Wallets  string
+	Goods    string
+	Sessions string
+}
+
+//AllBackends uses the same backend for every store, e.g. "memory"
+func AllBackends(name string) Backends {
+	return Backends{Users: name, Wallets: name, Goods: name, Sessions: name}
+} //AllBackends()
+
+func (b Backends) uses(name string) bool {
+	return b.Users == name || b.Wallets == name || b.Goods == name || b.Sessions == name
+} //Backends.uses()
+
+func DefaultConfig() Config {
+	return Config{
+		MongoURI:       "mongodb://localhost:27017",
+		DBName:         "taxiching",
+		BankMinBalance: wallets.NewMoney(wallets.DefaultCurrency, -10000000),
+		Sessions:       sessions.DefaultOptions(),
+		Backends: Backends{
+			Users:    "mongo",
+			Wallets:  "mongo",
+			Goods:    "mongo",
+			Sessions: "memory",
+		},
+	}
+} //DefaultConfig()
+
+var dbNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,63}$`)
+
+//Validate checks the config and fills in the session defaults
+func (c Config) Validate() (Config, error) {
+	if _, err := journals.Get(c.Backends.Wallets); err != nil {
+		return c, log.Wrapf(nil, "no transaction store for wallets backend \"%s\", registered: %v", c.Backends.Wallets, journals.Names())
+	}
+	if c.Backends.uses("mongo") && len(c.MongoURI) == 0 {
+		return c, log.Wrapf(nil, "missing mongo URI")
+	}
+	if !dbNamePattern.MatchString(c.DBName) {
+		return c, log.Wrapf(nil, "invalid db name \"%s\"", c.DBName)
+	}
+	m, err := users.ValidateMsisdn(c.AdminMsisdn)
+	if err != nil {
+		return c, log.Wrapf(err, "invalid admin msisdn")
+	}
+	c.AdminMsisdn = m
+	if _, err := wallets.ValidateCurrency(string(c.BankMinBalance.Currency)); err != nil {
+		return c, log.Wrapf(err, "invalid bank min balance")
+	}
+	if c.BankMinBalance.IsPositive() {
+		return c, log.Wrapf(nil, "bank min balance %s is positive, deposits will fail", c.BankMinBalance)
+	}
+	fx := make(map[wallets.Currency]bool)
+	for _, m := range c.FXMinBalances {
+		if _, err := wallets.ValidateCurrency(string(m.Currency)); err != nil {
+			return c, log.Wrapf(err, "invalid FX min balance")
+		}
+		if m.IsPositive() {
+			return c, log.Wrapf(nil, "FX min balance %s is positive, conversions will fail", m)
+		}
+		if fx[m.Currency] {
+			return c, log.Wrapf(nil, "duplicate FX min balance for %s", m.Currency)
+		}
+		fx[m.Currency] = true
+	}
+	if c.Sessions, err = c.Sessions.Validate(); err != nil {
+		return c, log.Wrapf(err, "invalid session config")
+	}
+	return c, nil
+} //Config.Validate()
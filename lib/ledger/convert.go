@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"math/big"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//Convert sends amount from one wallet to a wallet in another currency
+//at the supplied rate, which is units of the to-currency per unit of
+//the from-currency, e.g. "0.78" to convert ZAR to BWP
+//the money goes through the bank FX wallet of each currency so every
+//currency still balances to zero:
+//
+//	from -> fx-<from currency>   in the from currency
+//	fx-<to currency> -> to       in the to currency
+//
+//both legs are posted together and record the rate
+//the FX wallets are created by Setup() for the currencies in
+//Config.FXMinBalances, conversions to or from other currencies are refused
+//the rate is supplied by the caller, so it needs PermConvert
+func (b Bank) Convert(s sessions.ISession, from wallets.IWallet, to wallets.IWallet, amount wallets.Money, rate string, reference string) ([]ITransaction, error) {
+	if err := b.checkSession(s); err != nil {
+		return nil, err
+	}
+	if from == nil {
+		return nil, log.Wrapf(nil, "from wallet not specified")
+	}
+	if to == nil {
+		return nil, log.Wrapf(nil, "to wallet not specified")
+	}
+	if from.Currency() == to.Currency() {
+		return nil, log.Wrapf(nil, "cannot convert %s to the same currency, use send", from.Currency())
+	}
+	if !amount.IsPositive() || amount.Currency != from.Currency() {
+		return nil, log.Wrapf(nil, "convert requires positive amount in %s", from.Currency())
+	}
+	if len(reference) == 0 {
+		return nil, log.Wrapf(nil, "convert requires reference")
+	}
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return nil, log.Wrapf(nil, "invalid rate=\"%s\"", rate)
+	}
+	converted, err := amount.Convert(to.Currency(), r)
+	if err != nil {
+		return nil, err
+	}
+	if !converted.IsPositive() {
+		return nil, log.Wrapf(nil, "%s at rate %s is less than the smallest %s unit", amount, rate, to.Currency())
+	}
+
+	if err := b.authorize(s, users.PermConvert); err != nil {
+		return nil, err
+	}
+	u := s.User()
+	if from.Owner().ID() != u.ID() {
+		return nil, errorf(ErrPermission, "cannot convert from other user's wallet")
+	}
+	if from.Balance().Units-amount.Units < from.MinBalance().Units {
+		return nil, errorf(ErrFunds, "insufficient funds (w:{id:%s,bal:%s,min-bal:%s} a:%s)", from.ID(), from.Balance(), from.MinBalance(), amount)
+	}
+
+	fxFrom, err := b.fxWallet(from.Currency())
+	if err != nil {
+		return nil, err
+	}
+	fxTo, err := b.fxWallet(to.Currency())
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := b.post(
+		transaction{
+			dtWallet:    from,
+			ctWallet:    fxFrom,
+			amount:      amount,
+			description: "convert",
+			reference:   reference,
+			userID:      u.ID(),
+			rate:        rate,
+		},
+		transaction{
+			dtWallet:    fxTo,
+			ctWallet:    to,
+			amount:      converted,
+			description: "convert",
+			reference:   reference,
+			userID:      u.ID(),
+			rate:        rate,
+		})
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to convert %s to %s", amount, to.Currency())
+	}
+	return list, nil
+} //Convert()
+
+//fxWallet returns the bank FX wallet for a currency
+func (b Bank) fxWallet(currency wallets.Currency) (wallets.IWallet, error) {
+	if b.BankWallet == nil {
+		return nil, log.Wrapf(nil, "no bank wallet")
+	}
+	w := b.Wallets.UserWallet(b.BankWallet.Owner().ID(), fxWalletName(currency))
+	if w == nil {
+		return nil, log.Wrapf(nil, "no FX wallet for %s, see Config.FXMinBalances", currency)
+	}
+	return w, nil
+} //Bank.fxWallet()
+
+func fxWalletName(currency wallets.Currency) string {
+	return "fx-" + string(currency)
+} //fxWalletName()
+
+//setupFX creates the missing bank FX wallets, each may go down to its
+//minimum balance, because it holds the opposite of what was converted
+//in its currency
+//existing FX wallets keep their minimum balance
+func (b *Bank) setupFX(minBalances []wallets.Money) error {
+	owner := b.BankWallet.Owner()
+	for _, minBalance := range minBalances {
+		name := fxWalletName(minBalance.Currency)
+		if w := b.Wallets.UserWallet(owner.ID(), name); w != nil {
+			continue
+		}
+		if _, err := b.Wallets.New(owner, name, minBalance); err != nil {
+			return log.Wrapf(err, "failed to create %s wallet", name)
+		}
+	}
+	return nil
+} //Bank.setupFX()
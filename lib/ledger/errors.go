@@ -0,0 +1,51 @@
+package ledger
+
+import (
+	"fmt"
+
+	"github.com/jansemmelink/log"
+)
+
+//ErrorKind tells why the ledger refused a request
+type ErrorKind int
+
+const (
+	//ErrSession is an invalid session, or one too old for the operation
+	ErrSession ErrorKind = iota + 1
+	//ErrPermission is an operation the user may not do
+	ErrPermission
+	//ErrFunds is a wallet balance that is too low
+	ErrFunds
+	//ErrConflict is an idempotency key used for a different transaction
+	ErrConflict
+)
+
+//Error is returned, not wrapped, when the ledger refuses a request for a
+//reason the client can act on
+type Error struct {
+	Kind    ErrorKind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(kind ErrorKind, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, args...)}
+} //errorf()
+
+//IsError is true when err is an *Error of the kind
+func IsError(err error, kind ErrorKind) bool {
+	e, ok := err.(*Error)
+	return ok && e.Kind == kind
+} //IsError()
+
+//wrapf wraps err like log.Wrapf, but returns an *Error as is, so that
+//callers can still see its kind
+func wrapf(err error, format string, args ...interface{}) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return log.Wrapf(err, format, args...)
+} //wrapf()
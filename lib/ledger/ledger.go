@@ -6,69 +6,115 @@ import (
 
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
 	"github.com/jansemmelink/taxiching/lib/wallets"
 	"github.com/satori/uuid"
 )
 
-//transact creates a new transaction
-func (b Bank) transact(dt, ct wallets.IWallet, txTime time.Time, amount wallets.Amount, desc, ref string) (ITransaction, error) {
-	if txTime.After(time.Now()) {
-		return nil, log.Wrapf(nil, "future transaction time = %v", txTime)
+//transact posts a new transaction
+//t is filled in by the caller except for the id and balances
+func (b Bank) transact(t transaction) (ITransaction, error) {
+	posted, err := b.post(t)
+	if err != nil && len(t.idempotencyKey) > 0 {
+		//may have lost a race with a retry using the same key
+		if existing := b.Transactions.GetIdempotent(t.userID, t.idempotencyKey); existing != nil {
+			return idempotent(existing, t)
+		}
 	}
-	if dt == nil {
-		return nil, log.Wrapf(nil, "debit wallet not specified")
-	}
-	if ct == nil {
-		return nil, log.Wrapf(nil, "credit wallet not specified")
-	}
-	if dt == ct {
-		return nil, log.Wrapf(nil, "debit and credit wallet are the same")
+	if err != nil {
+		return nil, err
 	}
-	if amount <= 0 {
-		return nil, log.Wrapf(nil, "amount not positive")
+	return posted[0], nil
+} //Transact()
+
+//post posts all the transactions together, or none of them
+func (b Bank) post(list ...transaction) ([]ITransaction, error) {
+	if b.Transactions == nil {
+		return nil, log.Wrapf(nil, "no transaction store")
 	}
-	if len(desc) == 0 || len(ref) == 0 {
-		return nil, log.Wrapf(nil, "desc and ref are required")
+	for _, t := range list {
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
 	}
 
 	//only one transaction at a time
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	//define the transaction and append
-	dt.Debit(amount)
-	ct.Credit(amount)
-	t := transaction{
-		id: uuid.NewV1().String(),
-		ts: time.Now(),
-
-		//details:
-		timestamp:      time.Now(),
-		dtWallet:       dt,
-		dtBalanceAfter: 0,
-		ctWallet:       ct,
-		ctBalanceAfter: 0,
-		amount:         amount,
-		description:    desc,
-		reference:      ref,
+	//post the transactions, the store fills in the balances after posting
+	//the time is taken under the lock, so it follows the posting order
+	now := time.Now()
+	pending := make([]ITransaction, 0, len(list))
+	for _, t := range list {
+		t.id = uuid.NewV1().String()
+		t.ts = now
+		t.timestamp = now
+		t.dtBalanceAfter = wallets.NewMoney(t.amount.Currency, 0)
+		t.ctBalanceAfter = wallets.NewMoney(t.amount.Currency, 0)
+		t.refunded = wallets.NewMoney(t.amount.Currency, 0)
+		pending = append(pending, t)
 	}
-	transactions = append(transactions, t)
-	return t, nil
-} //Transact()
+	posted, err := b.Transactions.Post(pending...)
+	if err != nil {
+		return nil, wrapf(err, "failed to post transaction")
+	}
+	return posted, nil
+} //Bank.post()
+
+func (t transaction) validate() error {
+	if t.dtWallet == nil {
+		return log.Wrapf(nil, "debit wallet not specified")
+	}
+	if t.ctWallet == nil {
+		return log.Wrapf(nil, "credit wallet not specified")
+	}
+	if t.dtWallet.ID() == t.ctWallet.ID() {
+		return log.Wrapf(nil, "debit and credit wallet are the same")
+	}
+	if !t.amount.IsPositive() {
+		return log.Wrapf(nil, "amount not positive")
+	}
+	if t.dtWallet.Currency() != t.amount.Currency || t.ctWallet.Currency() != t.amount.Currency {
+		return log.Wrapf(nil, "cannot post %s from %s wallet to %s wallet", t.amount, t.dtWallet.Currency(), t.ctWallet.Currency())
+	}
+	if len(t.description) == 0 || len(t.reference) == 0 {
+		return log.Wrapf(nil, "desc and ref are required")
+	}
+	return nil
+} //transaction.validate()
 
 var (
-	mutex        sync.Mutex
-	transactions = make([]ITransaction, 0)
+	mutex sync.Mutex
 )
 
 type ITransaction interface {
 	ID() string
 	Timestamp() time.Time
 	DebitWallet() wallets.IWallet
+	DebitBalanceAfter() wallets.Money
 	CreditWallet() wallets.IWallet
-	Amount() wallets.Amount
+	CreditBalanceAfter() wallets.Money
+	Amount() wallets.Money
 	Description() string
 	Reference() string
+
+	//UserID is the user who made the transaction
+	UserID() string
+	//IdempotencyKey is the client key used to detect retries, if any
+	IdempotencyKey() string
+
+	//OriginalID is the id of the transaction refunded by this one,
+	//empty when this is not a refund
+	OriginalID() string
+	//Refunded is the total amount refunded from this transaction
+	Refunded() wallets.Money
+	//Reversed is true once the full amount was refunded
+	Reversed() bool
+
+	//Rate is the exchange rate used when this is part of a currency
+	//conversion, empty otherwise
+	Rate() string
 }
 
 type transaction struct {
@@ -76,33 +122,86 @@ type transaction struct {
 	ts time.Time //time created
 
 	dtWallet       wallets.IWallet
-	dtBalanceAfter wallets.Amount
+	dtBalanceAfter wallets.Money
 
 	ctWallet       wallets.IWallet
-	ctBalanceAfter wallets.Amount
+	ctBalanceAfter wallets.Money
 
 	timestamp   time.Time
-	amount      wallets.Amount
+	amount      wallets.Money
 	description string
 	reference   string
-}
 
-func (t transaction) ID() string                    { return t.id }
-func (t transaction) Timestamp() time.Time          { return t.timestamp }
-func (t transaction) DebitWallet() wallets.IWallet  { return t.dtWallet }
-func (t transaction) CreditWallet() wallets.IWallet { return t.ctWallet }
-func (t transaction) Amount() wallets.Amount        { return t.amount }
-func (t transaction) Description() string           { return t.description }
-func (t transaction) Reference() string             { return t.reference }
+	userID         string
+	idempotencyKey string
 
-func All() []ITransaction {
-	return transactions
+	originalID string
+	refunded   wallets.Money
+
+	rate string
 }
 
+func (t transaction) ID() string                        { return t.id }
+func (t transaction) Timestamp() time.Time              { return t.timestamp }
+func (t transaction) DebitWallet() wallets.IWallet      { return t.dtWallet }
+func (t transaction) DebitBalanceAfter() wallets.Money  { return t.dtBalanceAfter }
+func (t transaction) CreditWallet() wallets.IWallet     { return t.ctWallet }
+func (t transaction) CreditBalanceAfter() wallets.Money { return t.ctBalanceAfter }
+func (t transaction) Amount() wallets.Money             { return t.amount }
+func (t transaction) Description() string               { return t.description }
+func (t transaction) Reference() string                 { return t.reference }
+func (t transaction) UserID() string                    { return t.userID }
+func (t transaction) IdempotencyKey() string            { return t.idempotencyKey }
+func (t transaction) OriginalID() string                { return t.originalID }
+func (t transaction) Refunded() wallets.Money           { return t.refunded }
+func (t transaction) Rate() string                      { return t.rate }
+func (t transaction) Reversed() bool                    { return t.refunded.Units >= t.amount.Units }
+
+//toTransaction returns a copy of t that can be modified
+func toTransaction(t ITransaction) transaction {
+	if tx, ok := t.(transaction); ok {
+		return tx
+	}
+	return transaction{
+		id:             t.ID(),
+		ts:             time.Now(),
+		timestamp:      t.Timestamp(),
+		dtWallet:       t.DebitWallet(),
+		dtBalanceAfter: t.DebitBalanceAfter(),
+		ctWallet:       t.CreditWallet(),
+		ctBalanceAfter: t.CreditBalanceAfter(),
+		amount:         t.Amount(),
+		description:    t.Description(),
+		reference:      t.Reference(),
+		userID:         t.UserID(),
+		idempotencyKey: t.IdempotencyKey(),
+		originalID:     t.OriginalID(),
+		refunded:       t.Refunded(),
+		rate:           t.Rate(),
+	}
+} //toTransaction()
+
+//withBalances returns a copy of t with the wallet balances after posting
+func withBalances(t ITransaction, dtBalanceAfter, ctBalanceAfter wallets.Money) ITransaction {
+	tx := toTransaction(t)
+	tx.dtBalanceAfter = dtBalanceAfter
+	tx.ctBalanceAfter = ctBalanceAfter
+	return tx
+} //withBalances()
+
+//withRefunded returns t with the total of the refunds posted against it
+func withRefunded(t ITransaction, refunded wallets.Money) ITransaction {
+	tx := toTransaction(t)
+	tx.refunded = refunded
+	return tx
+} //withRefunded()
+
 //Send money between wallets
-func (b Bank) Send(s sessions.ISession, from wallets.IWallet, to wallets.IWallet, amount wallets.Amount, reference string) (ITransaction, error) {
-	if !b.Sessions.IsValid(s) {
-		return nil, log.Wrapf(nil, "Invalid session")
+//idempotencyKey is optional, when specified, a retry with the same key by
+//the same user returns the original transaction instead of sending again
+func (b Bank) Send(s sessions.ISession, from wallets.IWallet, to wallets.IWallet, amount wallets.Money, reference string, idempotencyKey string) (ITransaction, error) {
+	if err := b.checkSession(s); err != nil {
+		return nil, err
 	}
 	if from == nil {
 		return nil, log.Wrapf(nil, "from wallet not specified")
@@ -113,39 +212,87 @@ func (b Bank) Send(s sessions.ISession, from wallets.IWallet, to wallets.IWallet
 	if from.ID() == to.ID() {
 		return nil, log.Wrapf(nil, "cannot send to same wallet")
 	}
-	if amount <= 0 {
+	if !amount.IsPositive() {
 		return nil, log.Wrapf(nil, "send requires positive amount")
 	}
+	if from.Currency() != amount.Currency || to.Currency() != amount.Currency {
+		return nil, log.Wrapf(nil, "cannot send %s from %s wallet to %s wallet", amount, from.Currency(), to.Currency())
+	}
 	if len(reference) == 0 {
 		return nil, log.Wrapf(nil, "send requires reference")
 	}
 
 	//check user permission
 	u := s.User()
-	log.Debugf("from=%v", from)
-	log.Debugf("from.owner=%v", from.Owner())
-	log.Debugf("from.owner.id=%v", from.Owner().ID())
-	log.Debugf("session.user=%v", u)
-	log.Debugf("session.user.id=%v", u.ID())
-	if from.Owner().ID() != u.ID() {
-		return nil, log.Wrapf(nil, "cannot send from other user's wallet")
+	if b.BankWallet != nil && from.ID() == b.BankWallet.ID() {
+		//deposits are loaded from the bank wallet by admins and tellers
+		if err := b.authorize(s, users.PermDeposit); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := b.authorize(s, users.PermSend); err != nil {
+			return nil, err
+		}
+		if from.Owner().ID() != u.ID() {
+			return nil, errorf(ErrPermission, "cannot send from other user's wallet")
+		}
+	}
+
+	send := transaction{
+		dtWallet:       from,
+		ctWallet:       to,
+		amount:         amount,
+		description:    "send",
+		reference:      reference,
+		userID:         u.ID(),
+		idempotencyKey: idempotencyKey,
+	}
+
+	//a retry returns what was done before, even if the balance has
+	//since changed
+	//both checks below run before the ledger is locked, so they only fail
+	//early: correctness depends on the store checking again when posting,
+	//which refuses a second transaction with the same user and key, and a
+	//debit below the minimum balance (see ITransactionStore.Post)
+	if len(idempotencyKey) > 0 {
+		if existing := b.Transactions.GetIdempotent(u.ID(), idempotencyKey); existing != nil {
+			return idempotent(existing, send)
+		}
 	}
 
 	//user wallets may not go negative, but bank account may
 	//as we debit it with deposits
-	if from.Balance()-amount < from.MinBalance() {
-		return nil, log.Wrapf(nil, "insufficient funds (w:{id:%s,bal:%d,min-bal:%d} a:%d)", from.ID(), from.Balance(), from.MinBalance(), amount)
+	if from.Balance().Units-amount.Units < from.MinBalance().Units {
+		return nil, errorf(ErrFunds, "insufficient funds (w:{id:%s,bal:%s,min-bal:%s} a:%s)", from.ID(), from.Balance(), from.MinBalance(), amount)
 	}
 
-	t, err := b.transact(
-		from,
-		to,
-		time.Now(),
-		amount,
-		"send",
-		reference)
+	t, err := b.transact(send)
 	if err != nil {
-		return nil, log.Wrapf(err, "failed to transact")
+		return nil, wrapf(err, "failed to transact")
 	}
 	return t, nil
 } //Send()
+
+//checkSession refuses invalid sessions and sessions that are too old to
+//move money, the user must log in again
+func (b Bank) checkSession(s sessions.ISession) error {
+	if !b.Sessions.IsValid(s) {
+		return errorf(ErrSession, "Invalid session")
+	}
+	if !b.Sessions.Options().Fresh(s) {
+		return errorf(ErrSession, "Session started at %v is too old for this operation, log in again", s.Start())
+	}
+	return nil
+} //Bank.checkSession()
+
+//idempotent returns the existing transaction if the retry asks for the
+//same thing, else the key was reused for a different request
+func idempotent(existing ITransaction, retry ITransaction) (ITransaction, error) {
+	if existing.Amount() != retry.Amount() ||
+		existing.DebitWallet().ID() != retry.DebitWallet().ID() ||
+		existing.CreditWallet().ID() != retry.CreditWallet().ID() {
+		return nil, errorf(ErrConflict, "idempotency key %s was already used for a different transaction", retry.IdempotencyKey())
+	}
+	log.Debugf("Retry with idempotency key %s returns transaction.id=%s", retry.IdempotencyKey(), existing.ID())
+	return existing, nil
+} //idempotent()
@@ -0,0 +1,413 @@
+package ledger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	sessionsmemory "github.com/jansemmelink/taxiching/lib/sessions/memory"
+	"github.com/jansemmelink/taxiching/lib/users"
+	usersmemory "github.com/jansemmelink/taxiching/lib/users/memory"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+	walletsmemory "github.com/jansemmelink/taxiching/lib/wallets/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//testBank is a bank in memory with a funded passenger paying a driver
+type testBank struct {
+	Bank
+	admin           sessions.ISession
+	passenger       sessions.ISession
+	driver          sessions.ISession
+	passengerWallet wallets.IWallet
+	driverWallet    wallets.IWallet
+}
+
+func newTestBank(t *testing.T, funds int64) testBank {
+	users.PasswordCost = bcrypt.MinCost
+	us, _ := usersmemory.Users()
+	ws, _ := walletsmemory.New(us)
+	ss, err := sessionsmemory.New(us, sessions.Options{})
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	tb := testBank{Bank: Bank{Users: us, Wallets: ws, Sessions: ss, Transactions: MemoryTransactions()}}
+
+	login := func(msisdn, name string, role users.Role, minBalance int64) (sessions.ISession, wallets.IWallet) {
+		u, err := us.New(msisdn, name, "1234")
+		if err != nil {
+			t.Fatalf("failed to make user: %v", err)
+		}
+		if err := u.SetRoles(role); err != nil {
+			t.Fatalf("failed to set roles: %v", err)
+		}
+		w, err := ws.New(u, "default", zar(minBalance))
+		if err != nil {
+			t.Fatalf("failed to make wallet: %v", err)
+		}
+		s, err := ss.New(u.ID(), "1234", sessions.Client{})
+		if err != nil {
+			t.Fatalf("failed to login: %v", err)
+		}
+		return s, w
+	}
+	tb.admin, tb.BankWallet = login("27820000000", "admin", users.RoleAdmin, -1000000)
+	tb.passenger, tb.passengerWallet = login("27810000000", "passenger", users.RolePassenger, 0)
+	tb.driver, tb.driverWallet = login("27800000000", "driver", users.RoleDriver, 0)
+	if funds > 0 {
+		if _, err := tb.Send(tb.admin, tb.BankWallet, tb.passengerWallet, zar(funds), "deposit", ""); err != nil {
+			t.Fatalf("failed to deposit: %v", err)
+		}
+	}
+	return tb
+}
+
+func zar(units int64) wallets.Money {
+	return wallets.NewMoney(wallets.DefaultCurrency, units)
+}
+
+//TestPost checks that every posting debits, credits and journals
+//together, or does none of it
+func TestPost(t *testing.T) {
+	tb := newTestBank(t, 1000)
+	tests := []struct {
+		units int64
+		ok    bool
+	}{
+		{400, true},
+		{600, true},
+		{1, false},
+		{0, false},
+		{-5, false},
+	}
+	for i, test := range tests {
+		_, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(test.units), "ride", "")
+		if (err == nil) != test.ok {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		journal := map[string]int64{}
+		all, failed := tb.Transactions.All()
+		if len(failed) > 0 {
+			t.Fatalf("send %d: journal entries failed to load: %v", i, failed)
+		}
+		for _, tx := range all {
+			journal[tx.DebitWallet().ID()] -= tx.Amount().Units
+			journal[tx.CreditWallet().ID()] += tx.Amount().Units
+		}
+		for _, w := range []wallets.IWallet{tb.BankWallet, tb.passengerWallet, tb.driverWallet} {
+			if w.Balance() != zar(journal[w.ID()]) {
+				t.Fatalf("send %d: wallet %s balance %s, journal %d", i, w.Name(), w.Balance(), journal[w.ID()])
+			}
+		}
+	}
+	if tb.passengerWallet.Balance() != zar(0) || tb.driverWallet.Balance() != zar(1000) {
+		t.Fatalf("wrong balances %s %s", tb.passengerWallet.Balance(), tb.driverWallet.Balance())
+	}
+}
+
+//TestBalanceAfter checks the balances recorded on each posted and
+//stored transaction
+func TestBalanceAfter(t *testing.T) {
+	tb := newTestBank(t, 1000)
+	tests := []struct {
+		units     int64
+		passenger int64
+		driver    int64
+	}{
+		{100, 900, 100},
+		{250, 650, 350},
+		{650, 0, 1000},
+	}
+	for i, test := range tests {
+		tx, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(test.units), "ride", "")
+		if err != nil {
+			t.Fatalf("send %d failed: %v", i, err)
+		}
+		stored := tb.Transactions.GetID(tx.ID())
+		for _, got := range []ITransaction{tx, stored} {
+			if got.DebitBalanceAfter() != zar(test.passenger) || got.CreditBalanceAfter() != zar(test.driver) {
+				t.Fatalf("send %d: balances after %s %s, expected %d %d", i, got.DebitBalanceAfter(), got.CreditBalanceAfter(), test.passenger, test.driver)
+			}
+		}
+	}
+}
+
+func TestStatementPaging(t *testing.T) {
+	tb := newTestBank(t, 1000)
+	const payments = 7
+	for i := 0; i < payments; i++ {
+		if _, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(10), "ride", ""); err != nil {
+			t.Fatalf("failed to pay: %v", err)
+		}
+	}
+	from := time.Now().Add(-time.Hour)
+	to := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		walletID string
+		limit    int
+		pages    []int //lines per page
+		closing  int64
+	}{
+		{tb.driverWallet.ID(), 1, []int{1, 1, 1, 1, 1, 1, 1}, 70},
+		{tb.driverWallet.ID(), 3, []int{3, 3, 1}, 70},
+		{tb.driverWallet.ID(), 7, []int{7}, 70},
+		{tb.driverWallet.ID(), 0, []int{7}, 70},
+		{tb.passengerWallet.ID(), 4, []int{4, 4}, 930},
+	}
+	for _, test := range tests {
+		cursor := ""
+		balance := zar(0)
+		for i, n := range test.pages {
+			st, err := tb.Statement(test.walletID, from, to, cursor, test.limit)
+			if err != nil {
+				t.Fatalf("limit %d page %d: %v", test.limit, i, err)
+			}
+			if len(st.Lines) != n || st.OpeningBalance != balance {
+				t.Fatalf("limit %d page %d: %d lines from %s, expected %d from %s", test.limit, i, len(st.Lines), st.OpeningBalance, n, balance)
+			}
+			for _, l := range st.Lines {
+				balance.Units += l.Amount.Units
+				if l.Balance != balance {
+					t.Fatalf("limit %d page %d: line balance %s, expected %s", test.limit, i, l.Balance, balance)
+				}
+			}
+			if st.ClosingBalance != balance {
+				t.Fatalf("limit %d page %d: closing %s, expected %s", test.limit, i, st.ClosingBalance, balance)
+			}
+			if (len(st.Next) == 0) != (i == len(test.pages)-1) {
+				t.Fatalf("limit %d page %d: next=%q", test.limit, i, st.Next)
+			}
+			cursor = st.Next
+		}
+		if balance != zar(test.closing) {
+			t.Fatalf("limit %d: closing %s, expected %d", test.limit, balance, test.closing)
+		}
+	}
+
+	if _, err := tb.Statement(tb.driverWallet.ID(), from, to, "", MaxStatementLimit+1); err == nil {
+		t.Fatalf("limit above %d allowed", MaxStatementLimit)
+	}
+	if _, err := tb.Statement(tb.driverWallet.ID(), to, from, "", 0); err == nil {
+		t.Fatalf("from after to allowed")
+	}
+}
+
+func TestRefund(t *testing.T) {
+	tb := newTestBank(t, 1000)
+	paid, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(500), "ride", "")
+	if err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+
+	//applied in order, each refund reduces what remains
+	tests := []struct {
+		name   string
+		s      sessions.ISession
+		amount wallets.Money
+		ok     bool
+	}{
+		{"other user", tb.passenger, zar(100), false},
+		{"other currency", tb.driver, wallets.NewMoney("BWP", 100), false},
+		{"zero", tb.driver, zar(0), false},
+		{"negative", tb.driver, zar(-100), false},
+		{"part", tb.driver, zar(200), true},
+		{"more than remains", tb.driver, zar(301), false},
+		{"refund any", tb.admin, zar(100), true},
+		{"rest", tb.driver, zar(200), true},
+		{"reversed", tb.driver, zar(1), false},
+	}
+	for _, test := range tests {
+		refund, err := tb.Refund(test.s, paid.ID(), test.amount, test.name)
+		if (err == nil) != test.ok {
+			t.Fatalf("refund %s: %v", test.name, err)
+		}
+		if err == nil && refund.OriginalID() != paid.ID() {
+			t.Fatalf("refund %s of transaction.id=%s", test.name, refund.OriginalID())
+		}
+	}
+	original := tb.Transactions.GetID(paid.ID())
+	if !original.Reversed() || original.Refunded() != zar(500) {
+		t.Fatalf("refunded %s of %s", original.Refunded(), original.Amount())
+	}
+	//refunded is the total of the refunds appended to the journal
+	all, _ := tb.Transactions.All()
+	refunds := zar(0)
+	for _, tx := range all {
+		if tx.OriginalID() == paid.ID() {
+			refunds.Units += tx.Amount().Units
+		}
+	}
+	if refunds != original.Refunded() {
+		t.Fatalf("journal has %s refunds, original refunded %s", refunds, original.Refunded())
+	}
+	if _, err := tb.Reverse(tb.driver, paid.ID(), "again"); err == nil {
+		t.Fatalf("reversed twice")
+	}
+	if tb.driverWallet.Balance() != zar(0) || tb.passengerWallet.Balance() != zar(1000) {
+		t.Fatalf("wrong balances %s %s", tb.driverWallet.Balance(), tb.passengerWallet.Balance())
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	tb := newTestBank(t, 1000)
+	tests := []struct {
+		key   string
+		units int64
+		same  int //index of the earlier send returning the same transaction, or -1
+		kind  ErrorKind
+	}{
+		{"", 100, -1, 0},
+		{"", 100, -1, 0},
+		{"a", 100, -1, 0},
+		{"a", 100, 2, 0},
+		{"a", 200, -1, ErrConflict},
+		{"b", 200, -1, 0},
+		{"b", 200, 5, 0},
+		{"c", 1000, -1, ErrFunds},
+	}
+	ids := make([]string, len(tests))
+	for i, test := range tests {
+		tx, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(test.units), "ride", test.key)
+		if test.kind != 0 {
+			if !IsError(err, test.kind) {
+				t.Fatalf("send %d: expected error kind %d, got %v", i, test.kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("send %d failed: %v", i, err)
+		}
+		ids[i] = tx.ID()
+		for j := 0; j < i; j++ {
+			if (ids[j] == ids[i]) != (j == test.same) {
+				t.Fatalf("send %d returned transaction.id=%s of send %d", i, ids[i], j)
+			}
+		}
+	}
+	if tb.driverWallet.Balance() != zar(500) || tb.passengerWallet.Balance() != zar(500) {
+		t.Fatalf("wrong balances %s %s", tb.driverWallet.Balance(), tb.passengerWallet.Balance())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(tb *testBank)
+		ok     bool
+	}{
+		{"posted", func(tb *testBank) {}, true},
+		{"unloadable entry", func(tb *testBank) {
+			tb.Transactions = failingStore{tb.Transactions}
+		}, false},
+		{"credit without debit", func(tb *testBank) {
+			tb.driverWallet.Credit(zar(1))
+		}, false},
+		{"moved without journal", func(tb *testBank) {
+			tb.passengerWallet.Debit(zar(1))
+			tb.driverWallet.Credit(zar(1))
+		}, false},
+		{"below min balance", func(tb *testBank) {
+			tb.passengerWallet.Debit(zar(2000))
+			tb.BankWallet.Credit(zar(2000))
+		}, false},
+	}
+	for _, test := range tests {
+		tb := newTestBank(t, 1000)
+		if _, err := tb.Send(tb.passenger, tb.passengerWallet, tb.driverWallet, zar(100), "ride", ""); err != nil {
+			t.Fatalf("failed to pay: %v", err)
+		}
+		test.change(&tb)
+		report, err := tb.Verify()
+		if err != nil {
+			t.Fatalf("%s: failed to verify: %v", test.name, err)
+		}
+		if report.OK() != test.ok || report.Wallets != 3 || report.Transactions != 2 {
+			t.Fatalf("%s: %+v", test.name, report)
+		}
+	}
+}
+
+//failingStore fails to load the last journal entry
+type failingStore struct {
+	ITransactionStore
+}
+
+func (s failingStore) All() ([]ITransaction, []error) {
+	list, failed := s.ITransactionStore.All()
+	last := list[len(list)-1]
+	return list[:len(list)-1], append(failed, fmt.Errorf("cannot load transaction.id=%s", last.ID()))
+}
+
+func TestConvert(t *testing.T) {
+	tb := newTestBank(t, 10000)
+	if err := tb.setupFX([]wallets.Money{zar(-100000), wallets.NewMoney("BWP", -1000)}); err != nil {
+		t.Fatalf("failed to setup FX: %v", err)
+	}
+	teller := tb.passenger.User()
+	if err := teller.SetRoles(users.RoleTeller); err != nil {
+		t.Fatalf("failed to set roles: %v", err)
+	}
+	bwp, err := tb.Wallets.New(teller, "bwp", wallets.NewMoney("BWP", 0))
+	if err != nil {
+		t.Fatalf("failed to make wallet: %v", err)
+	}
+	lsl, err := tb.Wallets.New(teller, "lsl", wallets.NewMoney("LSL", 0))
+	if err != nil {
+		t.Fatalf("failed to make wallet: %v", err)
+	}
+
+	//applied in order, the FX-BWP wallet may go down to BWP -10.00
+	tests := []struct {
+		name      string
+		s         sessions.ISession
+		to        wallets.IWallet
+		units     int64
+		rate      string
+		converted int64
+		ok        bool
+	}{
+		{"rate", tb.passenger, bwp, 1000, "0.78", 780, true},
+		{"truncated", tb.passenger, bwp, 333, "1/3", 111, true},
+		{"less than a unit", tb.passenger, bwp, 1, "0.5", 0, false},
+		{"invalid rate", tb.passenger, bwp, 100, "-1", 0, false},
+		{"no permission", tb.driver, bwp, 100, "1", 0, false},
+		{"no FX wallet", tb.passenger, lsl, 100, "1", 0, false},
+		{"FX min balance", tb.passenger, bwp, 200, "1", 0, false},
+		{"overflow", tb.passenger, bwp, 100, "1e18", 0, false},
+	}
+	for _, test := range tests {
+		from := tb.passengerWallet
+		if test.s == tb.driver {
+			from = tb.driverWallet
+		}
+		before, beforeTo := from.Balance(), test.to.Balance()
+		list, err := tb.Convert(test.s, from, test.to, zar(test.units), test.rate, test.name)
+		if (err == nil) != test.ok {
+			t.Fatalf("convert %s: %v", test.name, err)
+		}
+		if !test.ok {
+			if from.Balance() != before || test.to.Balance() != beforeTo {
+				t.Fatalf("convert %s: failed but moved money", test.name)
+			}
+			continue
+		}
+		converted := wallets.NewMoney("BWP", test.converted)
+		if len(list) != 2 ||
+			list[0].DebitWallet().ID() != from.ID() || list[0].Amount() != zar(test.units) ||
+			list[1].CreditWallet().ID() != test.to.ID() || list[1].Amount() != converted ||
+			list[0].Rate() != test.rate || list[1].Rate() != test.rate {
+			t.Fatalf("convert %s: wrong legs %+v", test.name, list)
+		}
+		if before.Units-from.Balance().Units != test.units || test.to.Balance().Units-beforeTo.Units != test.converted {
+			t.Fatalf("convert %s: balances %s %s", test.name, from.Balance(), test.to.Balance())
+		}
+	}
+
+	//each currency still balances to zero
+	report, err := tb.Verify()
+	if err != nil || !report.OK() {
+		t.Fatalf("ledger does not verify: %+v %v", report, err)
+	}
+}
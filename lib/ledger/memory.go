@@ -0,0 +1,197 @@
+package ledger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+func init() {
+	RegisterJournal("memory", func(mongoURI string, dbName string, wallets wallets.IWallets) (ITransactionStore, error) {
+		return MemoryTransactions(), nil
+	})
+}
+
+//MemoryTransactions creates a transaction store that only lives
+//as long as the process, for tests and demos
+func MemoryTransactions() ITransactionStore {
+	return &memoryStore{
+		list:     make([]ITransaction, 0),
+		byID:     make(map[string]int),
+		byKey:    make(map[idempotencyKey]int),
+		refunded: make(map[string]int64),
+	}
+} //MemoryTransactions()
+
+type memoryStore struct {
+	mutex sync.Mutex
+	list  []ITransaction
+	byID  map[string]int //index in list
+	byKey map[idempotencyKey]int
+
+	//refunded is the total of the refunds in list by original id,
+	//entries in list are never changed after they were appended
+	refunded map[string]int64
+}
+
+type idempotencyKey struct {
+	userID string
+	key    string
+}
+
+func (m *memoryStore) Post(list ...ITransaction) ([]ITransaction, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	//check all before changing anything
+	//pending has the changes of the transactions checked so far by wallet id
+	pending := make(map[string]int64)
+	for _, t := range list {
+		if err := m.check(t, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	posted := make([]ITransaction, 0, len(list))
+	for _, t := range list {
+		dt, ct := t.DebitWallet(), t.CreditWallet()
+		dt.Debit(t.Amount())
+		ct.Credit(t.Amount())
+		t = withBalances(t, dt.Balance(), ct.Balance())
+		m.list = append(m.list, t)
+		m.byID[t.ID()] = len(m.list) - 1
+		if len(t.IdempotencyKey()) > 0 {
+			m.byKey[idempotencyKey{userID: t.UserID(), key: t.IdempotencyKey()}] = len(m.list) - 1
+		}
+		if len(t.OriginalID()) > 0 {
+			m.refunded[t.OriginalID()] += t.Amount().Units
+		}
+		posted = append(posted, t)
+	}
+	return posted, nil
+} //memoryStore.Post()
+
+//get returns the entry at index i of list with the refunds posted
+//against it, called with the store locked
+func (m *memoryStore) get(i int) ITransaction {
+	t := m.list[i]
+	return withRefunded(t, wallets.NewMoney(t.Amount().Currency, m.refunded[t.ID()]))
+} //memoryStore.get()
+
+//check that t may be posted, called with the store locked
+func (m *memoryStore) check(t ITransaction, pending map[string]int64) error {
+	if t == nil {
+		return log.Wrapf(nil, "cannot post nil transaction")
+	}
+	//checked under the lock, so concurrent payments cannot overdraw
+	dt := t.DebitWallet()
+	if dt.Balance().Units+pending[dt.ID()]-t.Amount().Units < dt.MinBalance().Units {
+		return errorf(ErrFunds, "insufficient funds (w:{id:%s,bal:%s,min-bal:%s} a:%s)", dt.ID(), dt.Balance(), dt.MinBalance(), t.Amount())
+	}
+	pending[dt.ID()] -= t.Amount().Units
+	pending[t.CreditWallet().ID()] += t.Amount().Units
+	if _, ok := m.byID[t.ID()]; ok {
+		return log.Wrapf(nil, "duplicate transaction.id=%s", t.ID())
+	}
+	if len(t.IdempotencyKey()) > 0 {
+		if _, ok := m.byKey[idempotencyKey{userID: t.UserID(), key: t.IdempotencyKey()}]; ok {
+			return log.Wrapf(nil, "duplicate idempotency key %s", t.IdempotencyKey())
+		}
+	}
+	//a refund is only posted if the original still allows it
+	if len(t.OriginalID()) > 0 {
+		i, ok := m.byID[t.OriginalID()]
+		if !ok {
+			return log.Wrapf(nil, "unknown original transaction.id=%s", t.OriginalID())
+		}
+		if err := checkRefund(m.get(i), t); err != nil {
+			return err
+		}
+	}
+	return nil
+} //memoryStore.check()
+
+func (m *memoryStore) GetID(id string) ITransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if i, ok := m.byID[id]; ok {
+		return m.get(i)
+	}
+	return nil
+} //memoryStore.GetID()
+
+func (m *memoryStore) GetIdempotent(userID string, key string) ITransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if i, ok := m.byKey[idempotencyKey{userID: userID, key: key}]; ok {
+		return m.get(i)
+	}
+	return nil
+} //memoryStore.GetIdempotent()
+
+func (m *memoryStore) All() ([]ITransaction, []error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	//return a copy so callers cannot modify the journal
+	list := make([]ITransaction, len(m.list))
+	for i := range m.list {
+		list[i] = m.get(i)
+	}
+	return list, nil
+} //memoryStore.All()
+
+func (m *memoryStore) WalletTransactions(walletID string, from, to time.Time, after string, limit int) ([]ITransaction, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(after) > 0 {
+		if _, ok := m.byID[after]; !ok {
+			return nil, log.Wrapf(nil, "unknown transaction.id=%s", after)
+		}
+	}
+	list := make([]ITransaction, 0)
+	skip := len(after) > 0
+	for i, t := range m.list {
+		if skip {
+			skip = t.ID() != after
+			continue
+		}
+		if !involves(t, walletID) || t.Timestamp().Before(from) || !t.Timestamp().Before(to) {
+			continue
+		}
+		list = append(list, m.get(i))
+		if limit > 0 && len(list) >= limit {
+			break
+		}
+	}
+	return list, nil
+} //memoryStore.WalletTransactions()
+
+func (m *memoryStore) RecentWalletTransactions(walletID string, limit int) ([]ITransaction, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]ITransaction, 0, limit)
+	for i := len(m.list) - 1; i >= 0 && len(list) < limit; i-- {
+		if involves(m.list[i], walletID) {
+			list = append(list, m.get(i))
+		}
+	}
+	//back to posting order
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+} //memoryStore.RecentWalletTransactions()
+
+func (m *memoryStore) LastWalletTransaction(walletID string, before time.Time) ITransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := len(m.list) - 1; i >= 0; i-- {
+		t := m.list[i]
+		if involves(t, walletID) && t.Timestamp().Before(before) {
+			return m.get(i)
+		}
+	}
+	return nil
+} //memoryStore.LastWalletTransaction()
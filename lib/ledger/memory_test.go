@@ -0,0 +1,66 @@
+package ledger
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/jansemmelink/taxiching/lib/users"
+	usersmemory "github.com/jansemmelink/taxiching/lib/users/memory"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+	walletsmemory "github.com/jansemmelink/taxiching/lib/wallets/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//TestConcurrentOverdraw posts payments from one wallet in many goroutines
+//for more than its balance, only those covered by the balance may post
+func TestConcurrentOverdraw(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	us, _ := usersmemory.Users()
+	ws, _ := walletsmemory.New(us)
+	u, err := us.New("27821234567", "one", "1234")
+	if err != nil {
+		t.Fatalf("failed to make user: %v", err)
+	}
+	bankWallet, _ := ws.New(u, "bank", wallets.NewMoney(wallets.DefaultCurrency, -1000000))
+	from, _ := ws.New(u, "from", wallets.NewMoney(wallets.DefaultCurrency, 0))
+	to, _ := ws.New(u, "to", wallets.NewMoney(wallets.DefaultCurrency, 0))
+	b := Bank{Transactions: MemoryTransactions()}
+
+	const funded = 10
+	pay := func(dt, ct wallets.IWallet, units int64) error {
+		_, err := b.post(transaction{
+			dtWallet:    dt,
+			ctWallet:    ct,
+			amount:      wallets.NewMoney(wallets.DefaultCurrency, units),
+			description: "test",
+			reference:   "test",
+			userID:      u.ID(),
+		})
+		return err
+	}
+	if err := pay(bankWallet, from, funded*100); err != nil {
+		t.Fatalf("failed to fund: %v", err)
+	}
+
+	const payments = 100
+	wg := sync.WaitGroup{}
+	paid := make(chan bool, payments)
+	for i := 0; i < payments; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paid <- pay(from, to, 100) == nil
+		}()
+	}
+	wg.Wait()
+	close(paid)
+	n := 0
+	for ok := range paid {
+		if ok {
+			n++
+		}
+	}
+	if n != funded || from.Balance().Units != 0 || to.Balance().Units != funded*100 {
+		t.Fatalf("%d payments posted, balances %s %s", n, from.Balance(), to.Balance())
+	}
+}
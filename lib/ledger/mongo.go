@@ -0,0 +1,584 @@
+package ledger
+
+import (
+	"context"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//MongoTransactions stores the journal in the "transactions" collection
+//each transaction is inserted as an immutable document, the refunded
+//amount of a transaction is the sum of the refund documents referring to it
+//wallets are used to resolve the wallet ids when reading back
+//postings update the balances in the "wallets" collection of the same
+//database inside a multi-document transaction, so mongo must run as a
+//replica set
+func init() {
+	RegisterJournal("mongo", MongoTransactions)
+}
+
+//e.g. MongoTransactions("mongodb://localhost:27017", "taxiching", w)
+func MongoTransactions(mongoURI string, dbName string, wallets wallets.IWallets) (ITransactionStore, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, log.Wrapf(err, "Failed to create mongo client to %s", mongoURI)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, log.Wrapf(err, "Failed to connect to mongo %s", mongoURI)
+	}
+
+	collection := client.Database(dbName).Collection("transactions")
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "dtWallet", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Keys: bson.D{{Key: "ctWallet", Value: 1}, {Key: "timestamp", Value: 1}}},
+		{Keys: bson.D{{Key: "dtWallet", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "ctWallet", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "originalId", Value: 1}}},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "idempotencyKey", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"idempotencyKey": bson.M{"$exists": true}}),
+		},
+	}); err != nil {
+		return nil, log.Wrapf(err, "Failed to create transaction indexes")
+	}
+
+	//the counter is created before any db transaction uses it
+	counters := client.Database(dbName).Collection("counters")
+	if _, err := counters.UpdateOne(ctx,
+		bson.M{"_id": seqCounter},
+		bson.M{"$setOnInsert": bson.M{"seq": int64(0)}},
+		options.Update().SetUpsert(true)); err != nil {
+		return nil, log.Wrapf(err, "Failed to create transaction counter")
+	}
+
+	return &mongoStore{
+		wallets:           wallets,
+		client:            client,
+		collection:        collection,
+		walletCollection:  client.Database(dbName).Collection("wallets"),
+		counterCollection: counters,
+	}, nil
+} //MongoTransactions()
+
+//seqCounter is the counter of transaction sequence numbers
+const seqCounter = "transactions"
+
+type mongoStore struct {
+	wallets           wallets.IWallets
+	client            *mongo.Client
+	collection        *mongo.Collection
+	walletCollection  *mongo.Collection
+	counterCollection *mongo.Collection
+}
+
+//transactionDoc is the stored form of a transaction
+type transactionDoc struct {
+	ID             string    `bson:"id"`
+	Seq            int64     `bson:"seq"` //posting order, 0 for transactions posted before it was added
+	Created        time.Time `bson:"ts"`
+	Timestamp      time.Time `bson:"timestamp"`
+	DtWallet       string    `bson:"dtWallet"`
+	DtBalanceAfter int64     `bson:"dtBalanceAfter"`
+	CtWallet       string    `bson:"ctWallet"`
+	CtBalanceAfter int64     `bson:"ctBalanceAfter"`
+	Currency       string    `bson:"currency"`
+	Amount         int64     `bson:"amount"` //minor units of currency
+	Description    string    `bson:"description"`
+	Reference      string    `bson:"reference"`
+	UserID         string    `bson:"userId"`
+	IdempotencyKey string    `bson:"idempotencyKey,omitempty"`
+	OriginalID     string    `bson:"originalId,omitempty"`
+	Rate           string    `bson:"rate,omitempty"`
+}
+
+//Post updates the wallet balances and inserts the journal entries in one
+//multi-document transaction, so a failure at any point leaves the db
+//unchanged and the driver retries on transient errors
+//a refund is checked against the refunds of the original already in
+//the journal in the same transaction
+func (m *mongoStore) Post(list ...ITransaction) ([]ITransaction, error) {
+	docs := make([]transactionDoc, 0, len(list))
+	for _, t := range list {
+		if t == nil {
+			return nil, log.Wrapf(nil, "cannot post nil transaction")
+		}
+		docs = append(docs, docFromTransaction(t))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := m.client.UseSession(ctx, func(sc mongo.SessionContext) error {
+		_, err := sc.WithTransaction(sc, func(tc mongo.SessionContext) (interface{}, error) {
+			for i := range docs {
+				if err := m.postDoc(tc, list[i], &docs[i]); err != nil {
+					return nil, err
+				}
+			}
+			return nil, nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, wrapf(err, "failed to post transactions")
+	}
+
+	//mongo wallets read their balance from the db, so they are not
+	//debited or credited here
+	posted := make([]ITransaction, 0, len(list))
+	for i, t := range list {
+		posted = append(posted, withBalances(t,
+			wallets.NewMoney(t.Amount().Currency, docs[i].DtBalanceAfter),
+			wallets.NewMoney(t.Amount().Currency, docs[i].CtBalanceAfter)))
+	}
+	return posted, nil
+} //mongoStore.Post()
+
+//postDoc posts one transaction inside a db transaction
+//and sets the balances after posting in doc
+func (m *mongoStore) postDoc(ctx mongo.SessionContext, t ITransaction, doc *transactionDoc) error {
+	//concurrent refunds of the same original both debit its credit wallet,
+	//so they conflict on that wallet and the retry sees the other refund
+	if len(doc.OriginalID) > 0 {
+		original, err := m.getID(ctx, doc.OriginalID)
+		if err != nil {
+			return log.Wrapf(err, "unknown original transaction.id=%s", doc.OriginalID)
+		}
+		if err := checkRefund(original, t); err != nil {
+			return err
+		}
+	}
+
+	//debit may not take the wallet below its minimum balance
+	dtBalance, err := m.updateBalance(
+		ctx,
+		bson.M{
+			"id": doc.DtWallet,
+			"$expr": bson.M{"$gte": bson.A{
+				bson.M{"$subtract": bson.A{bson.M{"$ifNull": bson.A{"$balance", 0}}, doc.Amount}},
+				"$minBalance",
+			}},
+		},
+		-doc.Amount)
+	if err == mongo.ErrNoDocuments {
+		return errorf(ErrFunds, "insufficient funds in wallet.id=%s", doc.DtWallet)
+	}
+	if err != nil {
+		return log.Wrapf(err, "cannot debit wallet.id=%s", doc.DtWallet)
+	}
+	ctBalance, err := m.updateBalance(ctx, bson.M{"id": doc.CtWallet}, doc.Amount)
+	if err == mongo.ErrNoDocuments {
+		return log.Wrapf(nil, "unknown wallet.id=%s", doc.CtWallet)
+	}
+	if err != nil {
+		return log.Wrapf(err, "cannot credit wallet.id=%s", doc.CtWallet)
+	}
+
+	//the sequence is taken in the db transaction, so concurrent postings,
+	//also from other server instances, conflict on the counter and get
+	//numbers in the order they commit
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	if err := m.counterCollection.FindOneAndUpdate(ctx,
+		bson.M{"_id": seqCounter},
+		bson.M{"$inc": bson.M{"seq": int64(1)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&counter); err != nil {
+		return log.Wrapf(err, "failed to get transaction sequence")
+	}
+
+	//the callback may be retried, so only set the balances here
+	doc.Seq = counter.Seq
+	doc.DtBalanceAfter = dtBalance
+	doc.CtBalanceAfter = ctBalance
+	if _, err := m.collection.InsertOne(ctx, doc); err != nil {
+		return log.Wrapf(err, "failed to insert transaction.id=%s into db", doc.ID)
+	}
+	return nil
+} //mongoStore.postDoc()
+
+//updateBalance adds amount to the balance of the wallet matching filter
+//and returns the new balance
+func (m *mongoStore) updateBalance(ctx context.Context, filter bson.M, amount int64) (int64, error) {
+	var result struct {
+		Balance int64 `bson:"balance"`
+	}
+	err := m.walletCollection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$inc": bson.M{"balance": amount}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		//no wallet matched the filter, see postDoc()
+		return 0, err
+	}
+	if err != nil {
+		return 0, log.Wrapf(err, "failed to update balance")
+	}
+	return result.Balance, nil
+} //mongoStore.updateBalance()
+
+func (m *mongoStore) GetID(id string) ITransaction {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t, err := m.getID(ctx, id)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Failed to load transaction.id=%s: %v", id, err)
+		return nil
+	}
+	return t
+} //mongoStore.GetID()
+
+//getID loads the transaction with its refunds
+//it returns mongo.ErrNoDocuments when there is no such transaction
+func (m *mongoStore) getID(ctx context.Context, id string) (ITransaction, error) {
+	var doc transactionDoc
+	if err := m.collection.FindOne(ctx, bson.M{"id": id}).Decode(&doc); err != nil {
+		return nil, err
+	}
+	refunded, err := m.refunded(ctx, []string{doc.ID})
+	if err != nil {
+		return nil, err
+	}
+	return m.transactionFromDoc(doc, refunded, nil)
+} //mongoStore.getID()
+
+func (m *mongoStore) GetIdempotent(userID string, key string) ITransaction {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var doc transactionDoc
+	if err := m.collection.FindOne(ctx, bson.M{"userId": userID, "idempotencyKey": key}).Decode(&doc); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("Failed to find idempotency key %s: %v", key, err)
+		}
+		return nil
+	}
+	refunded, err := m.refunded(ctx, []string{doc.ID})
+	if err != nil {
+		log.Errorf("Failed to load refunds of transaction.id=%s: %v", doc.ID, err)
+		return nil
+	}
+	t, err := m.transactionFromDoc(doc, refunded, nil)
+	if err != nil {
+		log.Errorf("Failed to load transaction.id=%s: %v", doc.ID, err)
+		return nil
+	}
+	return t
+} //mongoStore.GetIdempotent()
+
+func (m *mongoStore) All() ([]ITransaction, []error) {
+	errs := []error{}
+	list, err := m.find(bson.M{}, options.Find().SetSort(postingOrder), &errs)
+	if err != nil {
+		errs = append(errs, log.Wrapf(err, "failed to get all transactions"))
+	}
+	return list, errs
+} //mongoStore.All()
+
+//postingOrder sorts transactions in the order they were posted
+//transactions from before the sequence was added have none, so they
+//come first, in the order of their time
+var postingOrder = bson.D{{Key: "seq", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "id", Value: 1}}
+
+//reverseOrder sorts the last posted transaction first
+var reverseOrder = bson.D{{Key: "seq", Value: -1}, {Key: "timestamp", Value: -1}, {Key: "id", Value: -1}}
+
+//WalletTransactions filters and pages in posting order, the range starts
+//at the first transaction of the wallet posted with timestamp >= from and
+//ends before the first one posted with timestamp >= to
+//timestamps are taken before posting, so with several server instances
+//they need not follow seq, and filtering on them while paging on seq
+//could skip or repeat lines
+func (m *mongoStore) WalletTransactions(walletID string, from, to time.Time, after string, limit int) ([]ITransaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	byWallet := bson.M{"$or": bson.A{bson.M{"dtWallet": walletID}, bson.M{"ctWallet": walletID}}}
+	first, err := m.firstAt(ctx, byWallet, from)
+	if err != nil {
+		return nil, err
+	}
+	if first == nil {
+		return []ITransaction{}, nil
+	}
+	filter := bson.A{byWallet, atOrAfterFilter(*first)}
+	end, err := m.firstAt(ctx, byWallet, to)
+	if err != nil {
+		return nil, err
+	}
+	if end != nil {
+		filter = append(filter, bson.M{"$nor": bson.A{atOrAfterFilter(*end)}})
+	}
+	if len(after) > 0 {
+		var cursor transactionDoc
+		if err := m.collection.FindOne(ctx, bson.M{"id": after}).Decode(&cursor); err != nil {
+			return nil, log.Wrapf(err, "unknown transaction.id=%s", after)
+		}
+		filter = append(filter, afterFilter(cursor))
+	}
+	opts := options.Find().SetSort(postingOrder)
+	if limit > 0 {
+		opts.SetLimit(int64(limit))
+	}
+	return m.find(bson.M{"$and": filter}, opts, nil)
+} //mongoStore.WalletTransactions()
+
+//LastWalletTransaction returns the last transaction of the wallet posted
+//before the first one with timestamp >= before, see WalletTransactions()
+func (m *mongoStore) LastWalletTransaction(walletID string, before time.Time) ITransaction {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	byWallet := bson.M{"$or": bson.A{bson.M{"dtWallet": walletID}, bson.M{"ctWallet": walletID}}}
+	filter := bson.A{byWallet}
+	end, err := m.firstAt(ctx, byWallet, before)
+	if err != nil {
+		log.Errorf("Failed to get last transaction of wallet.id=%s: %v", walletID, err)
+		return nil
+	}
+	if end != nil {
+		filter = append(filter, bson.M{"$nor": bson.A{atOrAfterFilter(*end)}})
+	}
+	list, err := m.find(
+		bson.M{"$and": filter},
+		options.Find().
+			SetSort(reverseOrder).
+			SetLimit(1),
+		nil)
+	if err != nil {
+		log.Errorf("Failed to get last transaction of wallet.id=%s: %v", walletID, err)
+		return nil
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+} //mongoStore.LastWalletTransaction()
+
+//firstAt returns the first transaction in posting order that matches
+//filter and has timestamp >= t, or nil if there is none
+func (m *mongoStore) firstAt(ctx context.Context, filter bson.M, t time.Time) (*transactionDoc, error) {
+	var doc transactionDoc
+	err := m.collection.FindOne(ctx,
+		bson.M{"$and": bson.A{filter, bson.M{"timestamp": bson.M{"$gte": t}}}},
+		options.FindOne().SetSort(postingOrder),
+	).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to find transaction at %v", t)
+	}
+	return &doc, nil
+} //mongoStore.firstAt()
+
+func (m *mongoStore) RecentWalletTransactions(walletID string, limit int) ([]ITransaction, error) {
+	list, err := m.find(
+		bson.M{"$or": bson.A{bson.M{"dtWallet": walletID}, bson.M{"ctWallet": walletID}}},
+		options.Find().SetSort(reverseOrder).SetLimit(int64(limit)),
+		nil)
+	if err != nil {
+		return nil, err
+	}
+	//back to posting order
+	for i, j := 0, len(list)-1; i < j; i, j = i+1, j-1 {
+		list[i], list[j] = list[j], list[i]
+	}
+	return list, nil
+} //mongoStore.RecentWalletTransactions()
+
+//afterFilter matches transactions posted after the cursor in postingOrder
+func afterFilter(cursor transactionDoc) bson.M {
+	if cursor.Seq > 0 {
+		return bson.M{"seq": bson.M{"$gt": cursor.Seq}}
+	}
+	noSeq := bson.M{"$in": bson.A{nil, int64(0)}}
+	return bson.M{"$or": bson.A{
+		bson.M{"seq": bson.M{"$gt": 0}},
+		bson.M{"seq": noSeq, "timestamp": bson.M{"$gt": cursor.Timestamp}},
+		bson.M{"seq": noSeq, "timestamp": cursor.Timestamp, "id": bson.M{"$gt": cursor.ID}},
+	}}
+} //afterFilter()
+
+//atOrAfterFilter matches the cursor and the transactions posted after it
+func atOrAfterFilter(cursor transactionDoc) bson.M {
+	return bson.M{"$or": bson.A{bson.M{"id": cursor.ID}, afterFilter(cursor)}}
+} //atOrAfterFilter()
+
+//find returns the transactions matching the filter
+//wallets are resolved once per call
+//entries that cannot be loaded are added to failed, or only logged when
+//failed is nil
+func (m *mongoStore) find(filter interface{}, opts *options.FindOptions, failed *[]error) ([]ITransaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	list := make([]ITransaction, 0)
+	cur, err := m.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return list, log.Wrapf(err, "failed to find transactions")
+	}
+	defer cur.Close(ctx)
+
+	fail := func(err error) {
+		if failed == nil {
+			log.Errorf("%v", err)
+			return
+		}
+		*failed = append(*failed, err)
+	}
+	docs := make([]transactionDoc, 0)
+	for cur.Next(ctx) {
+		var doc transactionDoc
+		if err := cur.Decode(&doc); err != nil {
+			fail(log.Wrapf(err, "failed to decode transaction %s", cur.Current))
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	if err := cur.Err(); err != nil {
+		return list, log.Wrapf(err, "failed to read transactions")
+	}
+
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	refunded, err := m.refunded(ctx, ids)
+	if err != nil {
+		return list, err
+	}
+	walletByID := make(map[string]wallets.IWallet)
+	for _, doc := range docs {
+		t, err := m.transactionFromDoc(doc, refunded, walletByID)
+		if err != nil {
+			fail(log.Wrapf(err, "failed to load transaction.id=%s", doc.ID))
+			continue
+		}
+		list = append(list, t)
+	}
+	return list, nil
+} //mongoStore.find()
+
+//refunded returns the total of the refunds in the journal by original id
+func (m *mongoStore) refunded(ctx context.Context, ids []string) (map[string]int64, error) {
+	refunded := make(map[string]int64)
+	if len(ids) == 0 {
+		return refunded, nil
+	}
+	cur, err := m.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"originalId": bson.M{"$in": ids}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$originalId", "units": bson.M{"$sum": "$amount"}}}},
+	})
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to find refunds")
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var total struct {
+			OriginalID string `bson:"_id"`
+			Units      int64  `bson:"units"`
+		}
+		if err := cur.Decode(&total); err != nil {
+			return nil, log.Wrapf(err, "failed to decode refunds")
+		}
+		refunded[total.OriginalID] = total.Units
+	}
+	if err := cur.Err(); err != nil {
+		return nil, log.Wrapf(err, "failed to read refunds")
+	}
+	return refunded, nil
+} //mongoStore.refunded()
+
+func docFromTransaction(t ITransaction) transactionDoc {
+	doc := transactionDoc{
+		ID:             t.ID(),
+		Created:        time.Now(),
+		Timestamp:      t.Timestamp(),
+		DtWallet:       t.DebitWallet().ID(),
+		DtBalanceAfter: t.DebitBalanceAfter().Units,
+		CtWallet:       t.CreditWallet().ID(),
+		CtBalanceAfter: t.CreditBalanceAfter().Units,
+		Currency:       string(t.Amount().Currency),
+		Amount:         t.Amount().Units,
+		Description:    t.Description(),
+		Reference:      t.Reference(),
+		UserID:         t.UserID(),
+		IdempotencyKey: t.IdempotencyKey(),
+		OriginalID:     t.OriginalID(),
+		Rate:           t.Rate(),
+	}
+	if tx, ok := t.(transaction); ok {
+		doc.Created = tx.ts
+	}
+	return doc
+} //docFromTransaction()
+
+//transactionFromDoc makes the transaction with its total refunded taken
+//from refunded by id
+func (m *mongoStore) transactionFromDoc(doc transactionDoc, refunded map[string]int64, walletByID map[string]wallets.IWallet) (ITransaction, error) {
+	dt, err := m.wallet(doc.DtWallet, walletByID)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot load debit wallet")
+	}
+	ct, err := m.wallet(doc.CtWallet, walletByID)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot load credit wallet")
+	}
+	currency := wallets.Currency(doc.Currency)
+	if len(currency) == 0 {
+		currency = wallets.DefaultCurrency
+	}
+	return transaction{
+		id:             doc.ID,
+		ts:             doc.Created,
+		timestamp:      doc.Timestamp,
+		dtWallet:       dt,
+		dtBalanceAfter: wallets.NewMoney(currency, doc.DtBalanceAfter),
+		ctWallet:       ct,
+		ctBalanceAfter: wallets.NewMoney(currency, doc.CtBalanceAfter),
+		amount:         wallets.NewMoney(currency, doc.Amount),
+		description:    doc.Description,
+		reference:      doc.Reference,
+		userID:         doc.UserID,
+		idempotencyKey: doc.IdempotencyKey,
+		originalID:     doc.OriginalID,
+		refunded:       wallets.NewMoney(currency, refunded[doc.ID]),
+		rate:           doc.Rate,
+	}, nil
+} //mongoStore.transactionFromDoc()
+
+func (m *mongoStore) wallet(id string, walletByID map[string]wallets.IWallet) (wallets.IWallet, error) {
+	if w, ok := walletByID[id]; ok {
+		return w, nil
+	}
+	w := m.wallets.GetID(id)
+	if w == nil {
+		return nil, log.Wrapf(nil, "unknown wallet.id=%s", id)
+	}
+	if walletByID != nil {
+		walletByID[id] = w
+	}
+	return w, nil
+} //mongoStore.wallet()
@@ -0,0 +1,51 @@
+package ledger
+
+import (
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+//authorize refuses the operation when the session user does not have
+//the permission through one of their roles
+func (b Bank) authorize(s sessions.ISession, p users.Permission) error {
+	if s == nil || s.User() == nil {
+		return errorf(ErrSession, "Invalid session")
+	}
+	if !users.Can(s.User(), p) {
+		return errorf(ErrPermission, "user.id=%s with roles %v does not have permission %s", s.User().ID(), s.User().Roles(), p)
+	}
+	return nil
+} //Bank.authorize()
+
+//SetRoles replaces the roles of a user
+//admins cannot remove their own admin role, so there is always one left
+func (b Bank) SetRoles(s sessions.ISession, userID string, roles ...users.Role) (users.IUser, error) {
+	if !b.Sessions.IsValid(s) {
+		return nil, errorf(ErrSession, "Invalid session")
+	}
+	if err := b.authorize(s, users.PermManageRoles); err != nil {
+		return nil, err
+	}
+	u, err := b.Users.GetID(userID)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot get user.id=%s", userID)
+	}
+	if u == nil {
+		return nil, log.Wrapf(nil, "unknown user.id=%s", userID)
+	}
+	if u.ID() == s.User().ID() && users.HasRole(u, users.RoleAdmin) {
+		keepsAdmin := false
+		for _, r := range roles {
+			keepsAdmin = keepsAdmin || r == users.RoleAdmin
+		}
+		if !keepsAdmin {
+			return nil, log.Wrapf(nil, "cannot remove own admin role")
+		}
+	}
+	if err := u.SetRoles(roles...); err != nil {
+		return nil, log.Wrapf(err, "failed to set roles of user.id=%s", userID)
+	}
+	log.Debugf("Roles of user.id=%s set to %v by user.id=%s", u.ID(), u.Roles(), s.User().ID())
+	return u, nil
+} //Bank.SetRoles()
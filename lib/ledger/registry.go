@@ -0,0 +1,29 @@
+package ledger
+
+import (
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/registry"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//Journal opens the transaction store for a wallets backend, registered
+//with the same name as the wallets backend, because postings update
+//the wallets and the journal together
+type Journal func(mongoURI string, dbName string, wallets wallets.IWallets) (ITransactionStore, error)
+
+var journals = registry.New("journal")
+
+//RegisterJournal makes the journal available for the named wallets
+//backend, called from init()
+func RegisterJournal(name string, j Journal) {
+	journals.Add(name, j)
+} //RegisterJournal()
+
+//openJournal opens the journal registered for the wallets backend
+func openJournal(name string, mongoURI string, dbName string, wallets wallets.IWallets) (ITransactionStore, error) {
+	j, err := journals.Get(name)
+	if err != nil {
+		return nil, log.Wrapf(nil, "no transaction store for wallets backend \"%s\", registered: %v", name, journals.Names())
+	}
+	return j.(Journal)(mongoURI, dbName, wallets)
+} //openJournal()
@@ -0,0 +1,104 @@
+package ledger
+
+import (
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//Reverse refunds what remains of a transaction, e.g. when a passenger
+//paid for the wrong route or paid twice
+func (b Bank) Reverse(s sessions.ISession, txID string, reason string) (ITransaction, error) {
+	original := b.Transactions.GetID(txID)
+	if original == nil {
+		return nil, log.Wrapf(nil, "unknown transaction.id=%s", txID)
+	}
+	remaining, err := original.Amount().Sub(original.Refunded())
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot determine amount to reverse")
+	}
+	return b.Refund(s, txID, remaining, reason)
+} //Reverse()
+
+//Refund pays back part of a transaction from the wallet that was
+//credited to the wallet that was debited
+//the refund references the original, and the total refunded may
+//not exceed the original amount
+func (b Bank) Refund(s sessions.ISession, txID string, amount wallets.Money, reason string) (ITransaction, error) {
+	if err := b.checkSession(s); err != nil {
+		return nil, err
+	}
+	if len(reason) == 0 {
+		return nil, log.Wrapf(nil, "refund requires reason")
+	}
+	original := b.Transactions.GetID(txID)
+	if original == nil {
+		return nil, log.Wrapf(nil, "unknown transaction.id=%s", txID)
+	}
+
+	//the receiver of the money, or the bank, gives it back
+	from := original.CreditWallet()
+	to := original.DebitWallet()
+	u := s.User()
+	if from.Owner().ID() == u.ID() {
+		//refunding from own wallet is like sending from it
+		if err := b.authorize(s, users.PermSend); err != nil {
+			return nil, err
+		}
+	} else {
+		if !users.Can(u, users.PermRefundAny) {
+			return nil, errorf(ErrPermission, "cannot refund from other user's wallet")
+		}
+	}
+
+	refund := transaction{
+		dtWallet:    from,
+		ctWallet:    to,
+		amount:      amount,
+		description: "refund",
+		reference:   reason,
+		userID:      u.ID(),
+		originalID:  original.ID(),
+	}
+	if err := checkRefund(original, refund); err != nil {
+		return nil, err
+	}
+	if from.Balance().Units-amount.Units < from.MinBalance().Units {
+		return nil, errorf(ErrFunds, "insufficient funds (w:{id:%s,bal:%s,min-bal:%s} a:%s)", from.ID(), from.Balance(), from.MinBalance(), amount)
+	}
+
+	t, err := b.transact(refund)
+	if err != nil {
+		return nil, wrapf(err, "failed to refund transaction.id=%s", original.ID())
+	}
+	return t, nil
+} //Refund()
+
+//checkRefund checks that refund may be posted against original
+//stores call it again when posting so concurrent refunds cannot
+//exceed the original amount
+func checkRefund(original, refund ITransaction) error {
+	if len(original.OriginalID()) > 0 {
+		return log.Wrapf(nil, "cannot refund transaction.id=%s because it is a refund", original.ID())
+	}
+	if original.Reversed() {
+		return log.Wrapf(nil, "transaction.id=%s is already reversed", original.ID())
+	}
+	if refund.DebitWallet().ID() != original.CreditWallet().ID() || refund.CreditWallet().ID() != original.DebitWallet().ID() {
+		return log.Wrapf(nil, "refund must go back between the wallets of transaction.id=%s", original.ID())
+	}
+	if !refund.Amount().IsPositive() {
+		return log.Wrapf(nil, "refund requires positive amount")
+	}
+	if !refund.Amount().SameCurrency(original.Amount()) {
+		return log.Wrapf(nil, "cannot refund %s of a %s transaction", refund.Amount().Currency, original.Amount().Currency)
+	}
+	if original.Refunded().Units+refund.Amount().Units > original.Amount().Units {
+		return log.Wrapf(nil, "cannot refund %s, only %s of transaction.id=%s remains",
+			refund.Amount(),
+			wallets.NewMoney(original.Amount().Currency, original.Amount().Units-original.Refunded().Units),
+			original.ID())
+	}
+	return nil
+} //checkRefund()
@@ -0,0 +1,125 @@
+package ledger
+
+import (
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+const (
+	//DefaultStatementLimit is the page size used when none is specified
+	DefaultStatementLimit = 50
+	//MaxStatementLimit is the largest page size allowed
+	MaxStatementLimit = 500
+	//MiniStatementLimit is the number of lines in a mini statement
+	MiniStatementLimit = 10
+)
+
+//Statement is one page of a wallet's transactions
+type Statement struct {
+	Wallet         wallets.IWallet
+	From           time.Time
+	To             time.Time
+	OpeningBalance wallets.Money //balance before the first line
+	ClosingBalance wallets.Money //balance after the last line
+	Lines          []StatementLine
+	Next           string //cursor for the next page, empty on the last page
+}
+
+//StatementLine is a transaction as seen from the statement wallet
+type StatementLine struct {
+	Transaction ITransaction
+	Amount      wallets.Money //negative when the wallet was debited
+	Balance     wallets.Money //wallet balance after this line
+}
+
+//Statement returns the transactions of a wallet with from <= time < to
+//cursor is empty for the first page, then the Next value of the
+//previous page
+func (b Bank) Statement(walletID string, from, to time.Time, cursor string, limit int) (Statement, error) {
+	if b.Transactions == nil {
+		return Statement{}, log.Wrapf(nil, "no transaction store")
+	}
+	w := b.Wallets.GetID(walletID)
+	if w == nil {
+		return Statement{}, log.Wrapf(nil, "unknown wallet.id=%s", walletID)
+	}
+	if !from.Before(to) {
+		return Statement{}, log.Wrapf(nil, "from=%v is not before to=%v", from, to)
+	}
+	if limit <= 0 {
+		limit = DefaultStatementLimit
+	}
+	if limit > MaxStatementLimit {
+		return Statement{}, log.Wrapf(nil, "limit=%d may not exceed %d", limit, MaxStatementLimit)
+	}
+
+	//get one more than needed to know if there is another page
+	list, err := b.Transactions.WalletTransactions(walletID, from, to, cursor, limit+1)
+	if err != nil {
+		return Statement{}, log.Wrapf(err, "failed to get wallet transactions")
+	}
+
+	st := Statement{
+		Wallet:         w,
+		From:           from,
+		To:             to,
+		OpeningBalance: wallets.NewMoney(w.Currency(), 0),
+		Lines:          make([]StatementLine, 0, limit),
+	}
+	if len(list) > limit {
+		list = list[:limit]
+		st.Next = list[limit-1].ID()
+	}
+	for _, t := range list {
+		st.Lines = append(st.Lines, statementLine(t, walletID))
+	}
+
+	//opening balance is the balance before the first line, when there are
+	//no lines it is the balance after the previous page or before from
+	if len(st.Lines) > 0 {
+		st.OpeningBalance = wallets.NewMoney(w.Currency(), st.Lines[0].Balance.Units-st.Lines[0].Amount.Units)
+		st.ClosingBalance = st.Lines[len(st.Lines)-1].Balance
+	} else {
+		var previous ITransaction
+		if len(cursor) > 0 {
+			previous = b.Transactions.GetID(cursor)
+		} else {
+			previous = b.Transactions.LastWalletTransaction(walletID, from)
+		}
+		if previous != nil && involves(previous, walletID) {
+			st.OpeningBalance = statementLine(previous, walletID).Balance
+		}
+		st.ClosingBalance = st.OpeningBalance
+	}
+	return st, nil
+} //Bank.Statement()
+
+//MiniStatement returns the last MiniStatementLimit transactions of a wallet
+func (b Bank) MiniStatement(walletID string) ([]StatementLine, error) {
+	if b.Transactions == nil {
+		return nil, log.Wrapf(nil, "no transaction store")
+	}
+	list, err := b.Transactions.RecentWalletTransactions(walletID, MiniStatementLimit)
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to get wallet transactions")
+	}
+	lines := make([]StatementLine, 0, len(list))
+	for _, t := range list {
+		lines = append(lines, statementLine(t, walletID))
+	}
+	return lines, nil
+} //Bank.MiniStatement()
+
+func statementLine(t ITransaction, walletID string) StatementLine {
+	if t.DebitWallet().ID() == walletID {
+		return StatementLine{Transaction: t, Amount: t.Amount().Neg(), Balance: t.DebitBalanceAfter()}
+	}
+	return StatementLine{Transaction: t, Amount: t.Amount(), Balance: t.CreditBalanceAfter()}
+} //statementLine()
+
+//involves is true when the wallet is debited or credited in t
+func involves(t ITransaction, walletID string) bool {
+	return t.DebitWallet().ID() == walletID || t.CreditWallet().ID() == walletID
+} //involves()
@@ -0,0 +1,45 @@
+package ledger
+
+import (
+	"time"
+)
+
+//ITransactionStore is the journal of ledger transactions
+//transactions are only appended, never updated or removed, a refund is
+//appended as a new transaction and Refunded() of the original is the
+//total of the refunds in the journal
+type ITransactionStore interface {
+	//Post debits and credits the wallets of each transaction and appends
+	//them to the journal, either all of it happens or none of it
+	//it returns the transactions as stored, with the balances after posting
+	//it refuses a debit below the minimum balance of the wallet, checked
+	//atomically with the debit, so callers may check funds beforehand
+	//only to fail early
+	Post(list ...ITransaction) ([]ITransaction, error)
+	GetID(id string) ITransaction
+
+	//All returns the whole journal in posting order, with an error for
+	//each entry that could not be read back, e.g. for an unknown wallet
+	All() ([]ITransaction, []error)
+
+	//GetIdempotent returns the transaction the user posted with the
+	//idempotency key, or nil if there is none
+	//Post refuses a second transaction with the same user and key
+	GetIdempotent(userID string, key string) ITransaction
+
+	//WalletTransactions returns up to limit transactions of the wallet
+	//with from <= timestamp < to, in posting order, starting after the
+	//transaction with id=after when after is not empty
+	//a store where timestamps need not follow posting order takes the
+	//range in posting order from the first transaction at or after from
+	//limit <= 0 means no limit
+	WalletTransactions(walletID string, from, to time.Time, after string, limit int) ([]ITransaction, error)
+
+	//RecentWalletTransactions returns the last limit transactions of the
+	//wallet, in posting order
+	RecentWalletTransactions(walletID string, limit int) ([]ITransaction, error)
+
+	//LastWalletTransaction returns the last transaction of the wallet
+	//before the specified time, or nil if there is none
+	LastWalletTransaction(walletID string, before time.Time) ITransaction
+}
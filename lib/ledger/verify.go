@@ -0,0 +1,127 @@
+package ledger
+
+import (
+	"sort"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//VerifyReport is the result of checking the ledger
+type VerifyReport struct {
+	Wallets      int `json:"wallets"`
+	Transactions int `json:"transactions"`
+
+	//Totals is the sum of all stored wallet balances per currency,
+	//each must be zero because every debit has a matching credit
+	Totals []CurrencyTotal `json:"totals"`
+
+	//Discrepancies lists wallets where the stored balance differs
+	//from the balance recomputed from the journal
+	Discrepancies []WalletCheck `json:"discrepancies"`
+
+	//BelowMinBalance lists wallets with a stored balance below MinBalance
+	BelowMinBalance []WalletCheck `json:"belowMinBalance"`
+
+	//Errors lists journal entries that could not be loaded or checked,
+	//e.g. for unknown wallets
+	Errors []string `json:"errors"`
+}
+
+type CurrencyTotal struct {
+	Currency wallets.Currency `json:"currency"`
+	Total    wallets.Money    `json:"total"`
+}
+
+type WalletCheck struct {
+	WalletID   string           `json:"walletId"`
+	Owner      string           `json:"owner"`
+	Name       string           `json:"name"`
+	Currency   wallets.Currency `json:"currency"`
+	Balance    wallets.Money    `json:"balance"`
+	Journal    wallets.Money    `json:"journal"`
+	MinBalance wallets.Money    `json:"minBalance"`
+}
+
+//OK is true when there is no drift: all totals are zero, all balances
+//match the journal and no wallet is below its minimum balance
+func (r VerifyReport) OK() bool {
+	for _, t := range r.Totals {
+		if !t.Total.IsZero() {
+			return false
+		}
+	}
+	return len(r.Discrepancies) == 0 && len(r.BelowMinBalance) == 0 && len(r.Errors) == 0
+} //VerifyReport.OK()
+
+//Verify recomputes every wallet balance from the journal and compares
+//it with the stored balance
+func Verify(walletStore wallets.IWallets, transactions ITransactionStore) (VerifyReport, error) {
+	if walletStore == nil || transactions == nil {
+		return VerifyReport{}, log.Wrapf(nil, "cannot verify without wallets and transactions")
+	}
+
+	all := walletStore.All()
+	journal := make(map[string]int64, len(all))
+	r := VerifyReport{
+		Wallets:         len(all),
+		Discrepancies:   []WalletCheck{},
+		BelowMinBalance: []WalletCheck{},
+		Errors:          []string{},
+	}
+
+	list, failed := transactions.All()
+	r.Transactions = len(list) + len(failed)
+	for _, err := range failed {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	for _, t := range list {
+		dt, ct := t.DebitWallet(), t.CreditWallet()
+		if dt == nil || ct == nil || all[dt.ID()] == nil || all[ct.ID()] == nil {
+			r.Errors = append(r.Errors, log.Wrapf(nil, "transaction.id=%s refers to unknown wallet", t.ID()).Error())
+			continue
+		}
+		if dt.Currency() != t.Amount().Currency || ct.Currency() != t.Amount().Currency {
+			r.Errors = append(r.Errors, log.Wrapf(nil, "transaction.id=%s posted %s between %s and %s wallets", t.ID(), t.Amount(), dt.Currency(), ct.Currency()).Error())
+			continue
+		}
+		journal[dt.ID()] -= t.Amount().Units
+		journal[ct.ID()] += t.Amount().Units
+	}
+
+	totals := map[wallets.Currency]int64{}
+	for id, w := range all {
+		totals[w.Currency()] += w.Balance().Units
+		check := WalletCheck{
+			WalletID:   id,
+			Owner:      w.Owner().ID(),
+			Name:       w.Name(),
+			Currency:   w.Currency(),
+			Balance:    w.Balance(),
+			Journal:    wallets.NewMoney(w.Currency(), journal[id]),
+			MinBalance: w.MinBalance(),
+		}
+		if check.Balance != check.Journal {
+			r.Discrepancies = append(r.Discrepancies, check)
+		}
+		if check.Balance.Units < check.MinBalance.Units {
+			r.BelowMinBalance = append(r.BelowMinBalance, check)
+		}
+	}
+	for c, units := range totals {
+		r.Totals = append(r.Totals, CurrencyTotal{Currency: c, Total: wallets.NewMoney(c, units)})
+	}
+
+	//sort for stable reports
+	sort.Slice(r.Totals, func(i, j int) bool { return r.Totals[i].Currency < r.Totals[j].Currency })
+	sort.Slice(r.Discrepancies, func(i, j int) bool { return r.Discrepancies[i].WalletID < r.Discrepancies[j].WalletID })
+	sort.Slice(r.BelowMinBalance, func(i, j int) bool { return r.BelowMinBalance[i].WalletID < r.BelowMinBalance[j].WalletID })
+	return r, nil
+} //Verify()
+
+//Verify checks the bank's ledger while no transactions are posted
+func (b Bank) Verify() (VerifyReport, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return Verify(b.Wallets, b.Transactions)
+} //Bank.Verify()
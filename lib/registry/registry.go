@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jansemmelink/log"
+)
+
+//Registry holds the backends of one kind by name
+//packages wrap it with a typed Register() and Open()
+type Registry struct {
+	kind   string
+	mutex  sync.Mutex
+	byName map[string]interface{}
+}
+
+//New registry for backends of kind, e.g. "users"
+func New(kind string) *Registry {
+	return &Registry{
+		kind:   kind,
+		byName: make(map[string]interface{}),
+	}
+} //New()
+
+//Add the backend by name, it panics when the name is already taken
+func (r *Registry) Add(name string, b interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.byName[name]; ok {
+		panic(log.Wrapf(nil, "Multiple %s backends registered as \"%s\"", r.kind, name))
+	}
+	r.byName[name] = b
+} //Registry.Add()
+
+//Get the backend registered as name
+func (r *Registry) Get(name string) (interface{}, error) {
+	r.mutex.Lock()
+	b, ok := r.byName[name]
+	r.mutex.Unlock()
+	if !ok {
+		return nil, log.Wrapf(nil, "unknown %s backend \"%s\", registered: %v", r.kind, name, r.Names())
+	}
+	return b, nil
+} //Registry.Get()
+
+//Names of the registered backends, sorted
+func (r *Registry) Names() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := []string{}
+	for n := range r.byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+} //Registry.Names()
@@ -0,0 +1,50 @@
+package sessions
+
+import (
+	"sync"
+)
+
+//Hooks keeps the functions registered with OnStart, OnEnd and OnExpire
+//ISessions implementations embed it and call Started, Ended and Expired
+//without holding their own locks, so hooks may use the sessions
+type Hooks struct {
+	mutex    sync.Mutex
+	onStart  []func(ISession)
+	onEnd    []func(ISession)
+	onExpire []func(ISession)
+}
+
+//OnStart registers f to be called after a user logged in
+func (h *Hooks) OnStart(f func(ISession)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onStart = append(h.onStart, f)
+}
+
+//OnEnd registers f to be called after a session was ended by logout,
+//revoke or a newer login when only one session is allowed
+func (h *Hooks) OnEnd(f func(ISession)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onEnd = append(h.onEnd, f)
+}
+
+//OnExpire registers f to be called after an expired session was removed
+func (h *Hooks) OnExpire(f func(ISession)) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onExpire = append(h.onExpire, f)
+}
+
+func (h *Hooks) Started(s ISession) { h.call(&h.onStart, s) }
+func (h *Hooks) Ended(s ISession)   { h.call(&h.onEnd, s) }
+func (h *Hooks) Expired(s ISession) { h.call(&h.onExpire, s) }
+
+func (h *Hooks) call(list *[]func(ISession), s ISession) {
+	h.mutex.Lock()
+	hooks := *list
+	h.mutex.Unlock()
+	for _, f := range hooks {
+		f(s)
+	}
+} //Hooks.call()
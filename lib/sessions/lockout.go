@@ -0,0 +1,256 @@
+package sessions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+//Lockout tracks failed logins per user and per client IP
+//each failure after the free attempts doubles the time before the next
+//attempt is allowed, and a user is locked after MaxFailures until Unlock
+//the failures of users are kept in the users store, so locks hold across
+//restarts and server instances, while IP delays are local to this instance
+//IPs are only delayed, never locked, so one attacker cannot lock out
+//everyone behind the same IP
+//each login is first reserved with Attempt, which counts it as a failure
+//before the password is checked, so concurrent logins cannot all pass
+//before their failures are counted
+type Lockout struct {
+	MaxFailures    int           //user is locked after this many failures in a row
+	UserFree       int           //failures per user before delays start
+	IPFree         int           //failures per IP before delays start
+	BaseDelay      time.Duration //first delay, doubled after each failure
+	MaxDelay       time.Duration //delays never grow longer than this
+	ForgetAfter    time.Duration //failures are forgotten after this time without a failure
+	users          users.IUsers
+	mutex          sync.Mutex
+	byIP           map[string]*attempts
+	lastForgetting time.Time
+	onAudit        []func(event string, format string, args ...interface{})
+}
+
+type attempts struct {
+	failures int
+	last     time.Time //time of last failure
+	until    time.Time //no attempts allowed before this time
+}
+
+func NewLockout(users users.IUsers) *Lockout {
+	return &Lockout{
+		MaxFailures: 5,
+		UserFree:    1,
+		IPFree:      10,
+		BaseDelay:   time.Second,
+		MaxDelay:    5 * time.Minute,
+		ForgetAfter: 24 * time.Hour,
+		users:       users,
+		byIP:        make(map[string]*attempts),
+	}
+} //NewLockout()
+
+//UsersError is returned when the user could not be read to check the
+//login, once the attempt was reserved it still counts as a failure
+type UsersError struct {
+	Err error
+}
+
+func (e *UsersError) Error() string {
+	return "cannot get user: " + e.Err.Error()
+}
+
+//LoginError is returned when a login is refused before the password is
+//checked
+type LoginError struct {
+	Locked     bool          //user must be unlocked by an admin
+	RetryAfter time.Duration //else wait this long before trying again
+}
+
+func (e *LoginError) Error() string {
+	if e.Locked {
+		return "account is locked"
+	}
+	return fmt.Sprintf("too many failed attempts, retry after %v", e.RetryAfter.Round(time.Second))
+}
+
+//LoginAttempt is a login reserved by Lockout.Attempt, call Fail or
+//Success once the password was checked
+type LoginAttempt struct {
+	l          *Lockout
+	userID     string
+	ip         string
+	failures   int //of the user, including this attempt
+	ipFailures int //of the IP, including this attempt
+}
+
+//Attempt reserves a login of the user from ip before the password is
+//checked, by counting it as a failure
+//it returns a *LoginError if the user or IP may not try now, which is not
+//counted, unless concurrent attempts got past the first check
+func (l *Lockout) Attempt(userID string, ip string) (LoginAttempt, error) {
+	now := time.Now()
+	a := LoginAttempt{l: l, userID: userID, ip: ip}
+
+	//refuse without counting while delayed or locked
+	u, err := l.users.LoginAttempts(userID)
+	if err != nil {
+		return a, &UsersError{Err: err}
+	}
+	if err := l.refused(u, now); err != nil {
+		return a, err
+	}
+
+	l.mutex.Lock()
+	l.forget(now)
+	ipa, ok := l.byIP[ip]
+	if ok && now.Before(ipa.until) {
+		l.mutex.Unlock()
+		return a, &LoginError{RetryAfter: ipa.until.Sub(now)}
+	}
+	if !ok {
+		ipa = &attempts{}
+		l.byIP[ip] = ipa
+	}
+	ipa.failures++
+	ipa.last = now
+	ipa.until = now.Add(l.delay(ipa.failures, l.IPFree))
+	a.ipFailures = ipa.failures
+	l.mutex.Unlock()
+
+	//the users store counts atomically, so each concurrent attempt gets
+	//its own number of failures, and no more than MaxFailures of them
+	//may check the password
+	//an unknown user id only counts for the IP
+	if u, err = l.users.FailLogin(userID, now, now.Add(-l.ForgetAfter)); err != nil {
+		return a, &UsersError{Err: err}
+	}
+	a.failures = u.Failures
+	if a.failures == 0 {
+		return a, nil
+	}
+	if l.MaxFailures > 0 && a.failures > l.MaxFailures {
+		return a, &LoginError{Locked: true}
+	}
+	if err := l.refused(u, now); err != nil {
+		return a, err
+	}
+	//delay the next attempt as if this one fails
+	lock := l.MaxFailures > 0 && a.failures >= l.MaxFailures
+	if err := l.users.DelayLogin(userID, now.Add(l.delay(a.failures, l.UserFree)), lock); err != nil {
+		return a, &UsersError{Err: err}
+	}
+	return a, nil
+} //Lockout.Attempt()
+
+//refused returns a *LoginError when the user may not try now
+func (l *Lockout) refused(u users.LoginAttempts, now time.Time) error {
+	if u.Locked {
+		return &LoginError{Locked: true}
+	}
+	if now.Before(u.Until) {
+		return &LoginError{RetryAfter: u.Until.Sub(now)}
+	}
+	return nil
+} //Lockout.refused()
+
+//Fail keeps the failure counted by Attempt
+func (a LoginAttempt) Fail() {
+	if a.l.MaxFailures > 0 && a.failures == a.l.MaxFailures {
+		a.l.audit("ACCOUNT LOCKED", "user.id=%s after %d failed logins, last from ip=%s", a.userID, a.failures, a.ip)
+	}
+	if a.ipFailures == a.l.IPFree+1 {
+		a.l.audit("LOGIN DELAYED", "ip=%s after %d failed logins", a.ip, a.ipFailures)
+	}
+} //LoginAttempt.Fail()
+
+//Success clears the failures of the user after a successful login
+//the earlier IP failures are kept, else an attacker could reset them
+//with an account of their own, only this attempt is taken back
+func (a LoginAttempt) Success() {
+	if _, err := a.l.users.ClearLogins(a.userID); err != nil {
+		log.Errorf("Failed to clear failed logins of user.id=%s: %v", a.userID, err)
+	}
+	a.l.mutex.Lock()
+	defer a.l.mutex.Unlock()
+	if ipa, ok := a.l.byIP[a.ip]; ok && ipa.failures > 0 {
+		ipa.failures--
+		ipa.until = ipa.last.Add(a.l.delay(ipa.failures, a.l.IPFree))
+	}
+} //LoginAttempt.Success()
+
+//delay before the next attempt after failures, none for the free ones
+func (l *Lockout) delay(failures int, free int) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	delay := l.BaseDelay
+	for i := free + 1; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	return delay
+} //Lockout.delay()
+
+//Locked is true when the user must be unlocked before logging in
+func (l *Lockout) Locked(userID string) bool {
+	u, err := l.users.LoginAttempts(userID)
+	if err != nil {
+		log.Errorf("Failed to get failed logins of user.id=%s: %v", userID, err)
+		return false
+	}
+	return u.Locked
+} //Lockout.Locked()
+
+//Unlock clears the lock and failures of the user
+//by identifies who unlocked it, for the log
+func (l *Lockout) Unlock(userID string, by string) bool {
+	u, err := l.users.ClearLogins(userID)
+	if err != nil {
+		log.Errorf("Failed to unlock user.id=%s: %v", userID, err)
+		return false
+	}
+	if u.Locked {
+		l.audit("ACCOUNT UNLOCKED", "user.id=%s by %s", userID, by)
+	}
+	return u.Failures > 0 || u.Locked
+} //Lockout.Unlock()
+
+//OnAudit registers f to be called for the security events of the
+//lockout: ACCOUNT LOCKED, LOGIN DELAYED and ACCOUNT UNLOCKED
+//without any, they are logged as errors
+func (l *Lockout) OnAudit(f func(event string, format string, args ...interface{})) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onAudit = append(l.onAudit, f)
+} //Lockout.OnAudit()
+
+func (l *Lockout) audit(event string, format string, args ...interface{}) {
+	l.mutex.Lock()
+	hooks := l.onAudit
+	l.mutex.Unlock()
+	if len(hooks) == 0 {
+		log.Errorf("%s: %s", event, fmt.Sprintf(format, args...))
+		return
+	}
+	for _, f := range hooks {
+		f(event, format, args...)
+	}
+} //Lockout.audit()
+
+//forget removes old IP failures so the map does not grow without bound
+func (l *Lockout) forget(now time.Time) {
+	if now.Sub(l.lastForgetting) < time.Minute {
+		return
+	}
+	l.lastForgetting = now
+	for ip, a := range l.byIP {
+		if now.Sub(a.last) > l.ForgetAfter {
+			delete(l.byIP, ip)
+		}
+	}
+} //Lockout.forget()
@@ -0,0 +1,112 @@
+package sessions_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/users/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newLockout(t *testing.T) (*sessions.Lockout, users.IUser) {
+	users.PasswordCost = bcrypt.MinCost
+	us, err := memory.Users()
+	if err != nil {
+		t.Fatalf("failed to make users: %v", err)
+	}
+	u, err := us.New("27821234567", "one", "1234")
+	if err != nil {
+		t.Fatalf("failed to make user: %v", err)
+	}
+	return sessions.NewLockout(us), u
+}
+
+//TestLockoutBurst checks that concurrent wrong passwords cannot all get
+//past the lockout before their failures are counted
+func TestLockoutBurst(t *testing.T) {
+	l, u := newLockout(t)
+	//without delays only the lock stops the burst
+	l.BaseDelay = 0
+	audits := map[string]int{}
+	var mutex sync.Mutex
+	l.OnAudit(func(event string, format string, args ...interface{}) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		audits[event]++
+	})
+
+	const burst = 50
+	checked := 0
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := l.Attempt(u.ID(), "1.1.1.1")
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			checked++
+			mutex.Unlock()
+			a.Fail()
+		}()
+	}
+	wg.Wait()
+
+	if checked == 0 || checked > l.MaxFailures {
+		t.Fatalf("%d of %d attempts checked the password, max %d", checked, burst, l.MaxFailures)
+	}
+	if !l.Locked(u.ID()) {
+		t.Fatalf("user not locked after burst")
+	}
+	if audits["ACCOUNT LOCKED"] != 1 {
+		t.Fatalf("ACCOUNT LOCKED audited %d times", audits["ACCOUNT LOCKED"])
+	}
+	if _, err := l.Attempt(u.ID(), "2.2.2.2"); err == nil {
+		t.Fatalf("locked user may try")
+	}
+	if !l.Unlock(u.ID(), "test") || audits["ACCOUNT UNLOCKED"] != 1 {
+		t.Fatalf("unlock not audited: %v", audits)
+	}
+}
+
+func TestLockoutSuccess(t *testing.T) {
+	l, u := newLockout(t)
+	l.BaseDelay = time.Hour
+
+	//the free failure and a success leave no delay
+	a, err := l.Attempt(u.ID(), "1.1.1.1")
+	if err != nil {
+		t.Fatalf("first attempt refused: %v", err)
+	}
+	a.Fail()
+	if a, err = l.Attempt(u.ID(), "1.1.1.1"); err != nil {
+		t.Fatalf("second attempt refused: %v", err)
+	}
+	a.Success()
+	if a, err = l.Attempt(u.ID(), "1.1.1.1"); err != nil {
+		t.Fatalf("attempt after success refused: %v", err)
+	}
+
+	//after a second failure in a row the user is delayed, refused
+	//attempts do not count
+	a.Fail()
+	if a, err = l.Attempt(u.ID(), "1.1.1.1"); err != nil {
+		t.Fatalf("second attempt refused: %v", err)
+	}
+	a.Fail()
+	for i := 0; i < 10; i++ {
+		if _, err := l.Attempt(u.ID(), "1.1.1.1"); err == nil {
+			t.Fatalf("delayed user may try")
+		} else if e, ok := err.(*sessions.LoginError); !ok || e.Locked {
+			t.Fatalf("expected delay, got %v", err)
+		}
+	}
+	if l.Locked(u.ID()) {
+		t.Fatalf("refused attempts locked the user")
+	}
+}
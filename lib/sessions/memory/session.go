@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -10,57 +11,89 @@ import (
 	"github.com/satori/uuid"
 )
 
+func init() {
+	sessions.Register("memory", func(mongoURI string, dbName string, users users.IUsers, opts sessions.Options) (sessions.ISessions, error) {
+		return New(users, opts)
+	})
+}
+
 //new memory pool of sessions
-func New(users users.IUsers) (sessions.ISessions, error) {
+func New(users users.IUsers, opts sessions.Options) (sessions.ISessions, error) {
+	opts, err := opts.Validate()
+	if err != nil {
+		return nil, log.Wrapf(err, "invalid session options")
+	}
 	return &factory{
-		users: users,
-		byID:  make(map[string]sessions.ISession),
+		Hooks:   &sessions.Hooks{},
+		Lockout: sessions.NewLockout(users),
+		users:   users,
+		opts:    opts,
+		byID:    make(map[string]sessions.ISession),
 	}, nil
 } //New()
 
 type factory struct {
+	*sessions.Hooks
+	*sessions.Lockout
 	users users.IUsers
+	opts  sessions.Options
 	mutex sync.Mutex
 	byID  map[string]sessions.ISession
 }
 
-func (f *factory) New(userID string, password string) (sessions.ISession, error) {
+func (f *factory) New(userID string, password string, client sessions.Client) (sessions.ISession, error) {
 	if f == nil {
 		panic(log.Wrapf(nil, "nil.New()"))
 	}
 
-	log.Debugf("Creating session for %s %s", userID, password)
-	user := f.users.GetID(userID)
+	log.Debugf("Creating session for %s from %s", userID, client.IP)
+	attempt, err := f.Attempt(userID, client.IP)
+	if err != nil {
+		return nil, err
+	}
+	user, err := f.users.GetID(userID)
+	if err != nil {
+		return nil, &sessions.UsersError{Err: err}
+	}
 	if user == nil {
+		attempt.Fail()
 		return nil, log.Wrapf(nil, "unknown user")
 	}
 	if !user.Auth(password) {
+		attempt.Fail()
 		return nil, log.Wrapf(nil, "incorrect password")
 	}
+	attempt.Success()
 
 	newSession := &memorySession{
-		id:    uuid.NewV1().String(),
-		start: time.Now(),
-		user:  user,
-		data:  make(map[string]interface{}),
+		id:     uuid.NewV1().String(),
+		start:  time.Now(),
+		user:   user,
+		client: client,
+		opts:   f.opts,
+		data:   make(map[string]interface{}),
 	}
 	newSession.Extend()
 
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
 	if _, ok := f.byID[newSession.id]; ok {
+		f.mutex.Unlock()
 		panic(log.Wrapf(nil, "session factory created duplicate session id=\"%s\"", newSession.ID()))
 	}
 
-	//end and remove other sessions for the same user
+	//end and remove other sessions for the same user if only one allowed
+	ended := []sessions.ISession{}
+	expired := []sessions.ISession{}
 	for id, s := range f.byID {
-		if s.User().ID() == user.ID() {
+		if f.opts.SingleSession && s.User().ID() == user.ID() {
 			delete(f.byID, id)
+			ended = append(ended, s)
 			log.Debugf("  ENDING OTHER session.id=%s for user.id=%s started at %v", id, user.ID(), s.Start())
 			continue
 		}
 		if s.Expire().Before(time.Now()) {
 			delete(f.byID, id)
+			expired = append(expired, s)
 			log.Debugf("  ENDING EXPIRED session.id=%s for user.id=%s started at %v", id, user.ID(), s.Start())
 			continue
 		}
@@ -74,36 +107,119 @@ func (f *factory) New(userID string, password string) (sessions.ISession, error)
 		log.Debugf("SESSION START: {id:%s, start:%s, dur:%v, user:%s}", s.ID(), s.Start(), time.Now().Sub(s.Start()), s.User().ID())
 		f.logSessionList("started session.id=" + s.ID())
 	}
+	f.mutex.Unlock()
 
+	for _, s := range ended {
+		f.Ended(s)
+	}
+	for _, s := range expired {
+		f.Expired(s)
+	}
+	f.Started(newSession)
 	return newSession, nil
 } //f.New()
 
 func (f *factory) GetID(id string) sessions.ISession {
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
 	s, ok := f.byID[id]
 	if !ok {
 		f.logSessionList("session not found with id=" + id)
+		f.mutex.Unlock()
 		return nil
 	}
 	if s.Expire().Before(time.Now()) {
 		log.Debugf("Session.id=%s expired at %v", id, s.Expire())
 		delete(f.byID, id)
+		f.mutex.Unlock()
+		f.Expired(s)
 		return nil
 	}
+	f.mutex.Unlock()
 	//automatically extend the session while being used
-	s.Extend()
+	if f.opts.ExtendOnRead {
+		s.Extend()
+	}
 	return s
 } //GetID()
 
 func (f *factory) End(id string) {
 	f.mutex.Lock()
-	defer f.mutex.Unlock()
-	if s, ok := f.byID[id]; ok {
+	s, ok := f.byID[id]
+	if ok {
 		log.Debugf("SESSION ENDED: {id:%s, start:%s, dur:%v, user:%s}", s.ID(), s.Start(), time.Now().Sub(s.Start()), s.User().ID())
 		delete(f.byID, id)
 		f.logSessionList("ended session.id=" + s.ID())
 	}
+	f.mutex.Unlock()
+	if ok {
+		f.Ended(s)
+	}
+}
+
+func (f *factory) UserSessions(userID string) ([]sessions.ISession, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	list := []sessions.ISession{}
+	for _, s := range f.byID {
+		if s.User().ID() == userID && s.Expire().After(time.Now()) {
+			list = append(list, s)
+		}
+	}
+	return list, nil
+} //factory.UserSessions()
+
+func (f *factory) EndUser(userID string) {
+	f.mutex.Lock()
+	ended := []sessions.ISession{}
+	for id, s := range f.byID {
+		if s.User().ID() == userID {
+			log.Debugf("SESSION ENDED: {id:%s, start:%s, dur:%v, user:%s}", s.ID(), s.Start(), time.Now().Sub(s.Start()), userID)
+			delete(f.byID, id)
+			ended = append(ended, s)
+		}
+	}
+	f.mutex.Unlock()
+	for _, s := range ended {
+		f.Ended(s)
+	}
+} //factory.EndUser()
+
+func (f *factory) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debugf("Session reaper stopped")
+				return
+			case <-t.C:
+				f.reap()
+			}
+		}
+	}()
+} //factory.StartReaper()
+
+//reap removes expired sessions
+func (f *factory) reap() {
+	now := time.Now()
+	f.mutex.Lock()
+	expired := []sessions.ISession{}
+	for id, s := range f.byID {
+		if s.Expire().Before(now) {
+			delete(f.byID, id)
+			expired = append(expired, s)
+		}
+	}
+	f.mutex.Unlock()
+	for _, s := range expired {
+		log.Debugf("SESSION EXPIRED: {id:%s, start:%s, exp:%s, user:%s}", s.ID(), s.Start(), s.Expire(), s.User().ID())
+		f.Expired(s)
+	}
+} //factory.reap()
+
+func (f *factory) Options() sessions.Options {
+	return f.opts
 }
 
 func (f *factory) IsValid(s sessions.ISession) bool {
@@ -130,47 +246,67 @@ func (f *factory) logSessionList(title string) {
 }
 
 //memorySession implements ISession
+//it is safe for concurrent use, expire and data are guarded by mutex
 type memorySession struct {
 	id     string
 	start  time.Time
-	expire time.Time
 	user   users.IUser
+	client sessions.Client
+	opts   sessions.Options
+
+	mutex  sync.Mutex
+	expire time.Time
 	data   map[string]interface{}
 }
 
-func (s memorySession) ID() string {
+func (s *memorySession) ID() string {
 	return s.id
 }
 
-func (s memorySession) Start() time.Time {
+func (s *memorySession) Start() time.Time {
 	return s.start
 }
 
-func (s memorySession) Expire() time.Time {
+func (s *memorySession) Expire() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	return s.expire
 }
 
-func (s memorySession) User() users.IUser {
+func (s *memorySession) User() users.IUser {
 	return s.user
 }
 
+func (s *memorySession) Client() sessions.Client {
+	return s.client
+}
+
 func (s *memorySession) Set(n string, v interface{}) {
 	if s != nil {
+		s.mutex.Lock()
 		s.data[n] = v
+		s.mutex.Unlock()
 		s.Extend()
 	}
 }
 
 func (s *memorySession) Get(n string) (interface{}, bool) {
 	if s != nil {
+		s.mutex.Lock()
 		v, ok := s.data[n]
-		s.Extend()
+		s.mutex.Unlock()
+		if s.opts.ExtendOnRead {
+			s.Extend()
+		}
 		return v, ok
 	}
 	return nil, false
 }
 
 func (s *memorySession) Extend() {
-	s.expire = time.Now().Add(time.Minute * 5)
-	log.Debugf("+ %s: user.name=%s exp=%s", s.id, s.User().Name(), s.Expire())
+	s.mutex.Lock()
+	s.expire = s.opts.Expiry(s.start)
+	expire := s.expire
+	s.mutex.Unlock()
+	log.Debugf("+ %s: user.name=%s exp=%s", s.id, s.User().Name(), expire)
 }
@@ -0,0 +1,345 @@
+package mongo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/satori/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func init() {
+	sessions.Register("mongo", Sessions)
+}
+
+//Sessions are stored in the "sessions" collection so they survive a
+//restart and are shared by all server instances
+//a TTL index on expire lets mongo delete expired sessions, which it does
+//about once a minute, so reads also check the expiry
+//values stored with Set() must be encodable as BSON
+//e.g. Sessions("mongodb://localhost:27017", "taxiching", users, sessions.DefaultOptions())
+func Sessions(mongoURI string, dbName string, users users.IUsers, opts sessions.Options) (sessions.ISessions, error) {
+	opts, err := opts.Validate()
+	if err != nil {
+		return nil, log.Wrapf(err, "invalid session options")
+	}
+
+	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
+	if err != nil {
+		return nil, log.Wrapf(err, "Failed to create mongo client to %s", mongoURI)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		return nil, log.Wrapf(err, "Failed to connect to mongo %s", mongoURI)
+	}
+
+	collection := client.Database(dbName).Collection("sessions")
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+		{Keys: bson.D{{Key: "expire", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	}); err != nil {
+		return nil, log.Wrapf(err, "Failed to create session indexes")
+	}
+
+	return &factory{
+		Hooks:      &sessions.Hooks{},
+		Lockout:    sessions.NewLockout(users),
+		users:      users,
+		opts:       opts,
+		collection: collection,
+	}, nil
+} //Sessions()
+
+//factory implements ISessions
+type factory struct {
+	*sessions.Hooks
+	*sessions.Lockout
+	users      users.IUsers
+	opts       sessions.Options
+	collection *mongo.Collection
+}
+
+//sessionDoc is the stored form of a session
+type sessionDoc struct {
+	ID        string                 `bson:"id"`
+	UserID    string                 `bson:"userId"`
+	Start     time.Time              `bson:"start"`
+	Expire    time.Time              `bson:"expire"` //TTL index
+	Device    string                 `bson:"device,omitempty"`
+	IP        string                 `bson:"ip,omitempty"`
+	UserAgent string                 `bson:"userAgent,omitempty"`
+	Data      map[string]interface{} `bson:"data"`
+}
+
+func (f *factory) New(userID string, password string, client sessions.Client) (sessions.ISession, error) {
+	log.Debugf("Creating session for %s from %s", userID, client.IP)
+	attempt, err := f.Attempt(userID, client.IP)
+	if err != nil {
+		return nil, err
+	}
+	user, err := f.users.GetID(userID)
+	if err != nil {
+		return nil, &sessions.UsersError{Err: err}
+	}
+	if user == nil {
+		attempt.Fail()
+		return nil, log.Wrapf(nil, "unknown user")
+	}
+	if !user.Auth(password) {
+		attempt.Fail()
+		return nil, log.Wrapf(nil, "incorrect password")
+	}
+	attempt.Success()
+
+	//end other sessions for the same user if only one allowed
+	if f.opts.SingleSession {
+		if err := f.remove(bson.M{"userId": user.ID()}, f.Ended); err != nil {
+			return nil, log.Wrapf(err, "failed to end other sessions")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	doc := sessionDoc{
+		ID:        uuid.NewV1().String(),
+		UserID:    user.ID(),
+		Start:     now,
+		Expire:    f.opts.Expiry(now),
+		Device:    client.Device,
+		IP:        client.IP,
+		UserAgent: client.UserAgent,
+		Data:      make(map[string]interface{}),
+	}
+	if _, err := f.collection.InsertOne(ctx, doc); err != nil {
+		return nil, log.Wrapf(err, "failed to insert session into db")
+	}
+	log.Debugf("SESSION START: {id:%s, user:%s}", doc.ID, user.ID())
+	s := &mongoSession{f: f, doc: doc, user: user}
+	f.Started(s)
+	return s, nil
+} //factory.New()
+
+func (f *factory) GetID(id string) sessions.ISession {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var doc sessionDoc
+	if err := f.collection.FindOne(ctx, bson.M{"id": id, "expire": bson.M{"$gt": time.Now()}}).Decode(&doc); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("Failed to get session: %v", err)
+		}
+		return nil
+	}
+	user, err := f.users.GetID(doc.UserID)
+	if user == nil {
+		log.Errorf("Failed to get user.id=%s of session: %v", doc.UserID, err)
+		return nil
+	}
+	if doc.Data == nil {
+		doc.Data = make(map[string]interface{})
+	}
+	s := &mongoSession{f: f, doc: doc, user: user}
+
+	//automatically extend the session while being used
+	if f.opts.ExtendOnRead {
+		s.Extend()
+	}
+	return s
+} //factory.GetID()
+
+func (f *factory) Options() sessions.Options {
+	return f.opts
+} //factory.Options()
+
+func (f *factory) UserSessions(userID string) ([]sessions.ISession, error) {
+	found, err := f.find(bson.M{"userId": userID, "expire": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to find user sessions")
+	}
+	list := []sessions.ISession{}
+	for _, s := range found {
+		list = append(list, s)
+	}
+	return list, nil
+} //factory.UserSessions()
+
+func (f *factory) EndUser(userID string) {
+	if err := f.remove(bson.M{"userId": userID}, f.Ended); err != nil {
+		log.Errorf("Failed to end user sessions: %v", err)
+	}
+} //factory.EndUser()
+
+//StartReaper removes expired sessions before the TTL index does, so
+//that OnExpire hooks are called, mongo deletes those missed by the reaper
+//without calling hooks
+func (f *factory) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debugf("Session reaper stopped")
+				return
+			case <-t.C:
+				if err := f.remove(bson.M{"expire": bson.M{"$lte": time.Now()}}, f.Expired); err != nil {
+					log.Errorf("Failed to remove expired sessions: %v", err)
+				}
+			}
+		}
+	}()
+} //factory.StartReaper()
+
+//find returns the sessions matching the filter
+func (f *factory) find(filter bson.M) ([]*mongoSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cur, err := f.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, log.Wrapf(err, "failed to find sessions")
+	}
+	defer cur.Close(ctx)
+	list := []*mongoSession{}
+	for cur.Next(ctx) {
+		var doc sessionDoc
+		if err := cur.Decode(&doc); err != nil {
+			log.Errorf("Failed to decode session: %v", err)
+			continue
+		}
+		user, err := f.users.GetID(doc.UserID)
+		if user == nil {
+			log.Errorf("Failed to get user.id=%s of session: %v", doc.UserID, err)
+			continue
+		}
+		if doc.Data == nil {
+			doc.Data = make(map[string]interface{})
+		}
+		list = append(list, &mongoSession{f: f, doc: doc, user: user})
+	}
+	if err := cur.Err(); err != nil {
+		return nil, log.Wrapf(err, "failed to read sessions")
+	}
+	return list, nil
+} //factory.find()
+
+//remove deletes the sessions matching the filter and calls hook for each
+//session this instance deleted
+func (f *factory) remove(filter bson.M, hook func(sessions.ISession)) error {
+	found, err := f.find(filter)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, s := range found {
+		res, err := f.collection.DeleteOne(ctx, bson.M{"id": s.doc.ID})
+		if err != nil {
+			return log.Wrapf(err, "failed to delete session")
+		}
+		if res.DeletedCount > 0 {
+			log.Debugf("SESSION REMOVED: {id:%s, user:%s}", s.doc.ID, s.doc.UserID)
+			hook(s)
+		}
+	}
+	return nil
+} //factory.remove()
+
+func (f *factory) IsValid(s sessions.ISession) bool {
+	if s == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := f.collection.CountDocuments(ctx, bson.M{"id": s.ID(), "expire": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		log.Errorf("Failed to check session: %v", err)
+		return false
+	}
+	return n > 0
+} //factory.IsValid()
+
+func (f *factory) End(id string) {
+	if err := f.remove(bson.M{"id": id}, f.Ended); err != nil {
+		log.Errorf("Failed to end session: %v", err)
+	}
+} //factory.End()
+
+//mongoSession implements ISession
+//Set and Extend write through to the db
+type mongoSession struct {
+	f     *factory
+	mutex sync.Mutex
+	doc   sessionDoc
+	user  users.IUser
+}
+
+func (s *mongoSession) ID() string {
+	return s.doc.ID
+}
+
+func (s *mongoSession) Start() time.Time {
+	return s.doc.Start
+}
+
+func (s *mongoSession) Expire() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.doc.Expire
+}
+
+func (s *mongoSession) User() users.IUser {
+	return s.user
+}
+
+func (s *mongoSession) Client() sessions.Client {
+	return sessions.Client{Device: s.doc.Device, IP: s.doc.IP, UserAgent: s.doc.UserAgent}
+}
+
+func (s *mongoSession) Set(n string, v interface{}) {
+	s.mutex.Lock()
+	s.doc.Data[n] = v
+	s.doc.Expire = s.f.opts.Expiry(s.doc.Start)
+	expire := s.doc.Expire
+	s.mutex.Unlock()
+	s.update(bson.M{"data." + n: v, "expire": expire})
+}
+
+func (s *mongoSession) Get(n string) (interface{}, bool) {
+	s.mutex.Lock()
+	v, ok := s.doc.Data[n]
+	s.mutex.Unlock()
+	if s.f.opts.ExtendOnRead {
+		s.Extend()
+	}
+	return v, ok
+}
+
+func (s *mongoSession) Extend() {
+	s.mutex.Lock()
+	s.doc.Expire = s.f.opts.Expiry(s.doc.Start)
+	expire := s.doc.Expire
+	s.mutex.Unlock()
+	s.update(bson.M{"expire": expire})
+}
+
+func (s *mongoSession) update(set bson.M) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.f.collection.UpdateOne(ctx, bson.M{"id": s.doc.ID}, bson.M{"$set": set}); err != nil {
+		log.Errorf("Failed to update session.id=%s: %v", s.doc.ID, err)
+	}
+} //mongoSession.update()
@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"github.com/jansemmelink/taxiching/lib/registry"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+//Backend opens sessions of the users with the options, the "signed"
+//backend keeps no store and takes its keys from opts
+type Backend func(mongoURI string, dbName string, users users.IUsers, opts Options) (ISessions, error)
+
+var backends = registry.New("sessions")
+
+//Register makes the sessions backend available by name
+func Register(name string, b Backend) {
+	backends.Add(name, b)
+} //Register()
+
+//Open sessions with the named backend
+func Open(name string, mongoURI string, dbName string, users users.IUsers, opts Options) (ISessions, error) {
+	b, err := backends.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Backend)(mongoURI, dbName, users, opts)
+} //Open()
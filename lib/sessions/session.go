@@ -1,16 +1,130 @@
 package sessions
 
 import (
+	"context"
 	"time"
 
+	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/users"
 )
 
 type ISessions interface {
-	New(userID string, password string) (ISession, error)
+	//New logs the user in from the client
+	//repeated failures are delayed and eventually lock the user,
+	//returning a *LoginError
+	New(userID string, password string, client Client) (ISession, error)
 	GetID(id string) ISession
 	IsValid(s ISession) bool
 	End(id string)
+
+	//UserSessions returns the active sessions of the user
+	//or ErrUnsupported when the backend cannot list them
+	UserSessions(userID string) ([]ISession, error)
+	//EndUser ends all sessions of the user
+	EndUser(userID string)
+
+	//OnStart, OnEnd and OnExpire register functions called after a
+	//session started, ended or expired, e.g. to audit logins
+	OnStart(f func(ISession))
+	OnEnd(f func(ISession))
+	OnExpire(f func(ISession))
+
+	//StartReaper removes expired sessions every interval in the
+	//background, until ctx is done
+	StartReaper(ctx context.Context, interval time.Duration)
+
+	//Options returns the options the sessions were created with
+	Options() Options
+
+	//Locked is true when too many failed logins locked the user
+	Locked(userID string) bool
+	//Unlock allows the user to log in again, by is logged
+	Unlock(userID string, by string) bool
+	//OnAudit registers f to be called when failed logins lock a user or
+	//delay an IP, and when a user is unlocked
+	OnAudit(f func(event string, format string, args ...interface{}))
+}
+
+//ErrUnsupported is returned by backends that cannot do an operation,
+//e.g. signed sessions cannot list the tokens of a user
+var ErrUnsupported = log.Wrapf(nil, "not supported by this session backend")
+
+//Options control how sessions are managed
+type Options struct {
+	//SingleSession ends the other sessions of a user when they log in,
+	//else the user may be logged in on several devices
+	SingleSession bool
+
+	//IdleTimeout is how long a session lives after it was last extended
+	IdleTimeout time.Duration
+	//MaxLifetime is the absolute limit after the start, that extending
+	//cannot pass, 0 for no limit
+	MaxLifetime time.Duration
+	//ExtendOnRead extends the session on GetID and Get, else only
+	//Set and Extend (keepalive) extend it
+	ExtendOnRead bool
+
+	//FreshFor is how long after login a session may be used for sensitive
+	//operations like sending money, 0 for no limit
+	FreshFor time.Duration
+
+	//Keys sign the session tokens of backends that issue them, e.g.
+	//"signed", and are ignored by the others
+	Keys []Key
+}
+
+//Key is an HMAC key used to sign session tokens
+//the ID is written in each token so that older keys can still verify
+//tokens while a new key is rolled out
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+const DefaultIdleTimeout = 5 * time.Minute
+
+func DefaultOptions() Options {
+	return Options{
+		IdleTimeout:  DefaultIdleTimeout,
+		MaxLifetime:  12 * time.Hour,
+		ExtendOnRead: true,
+		FreshFor:     15 * time.Minute,
+	}
+} //DefaultOptions()
+
+//Validate fills in the default idle timeout and checks the durations
+func (o Options) Validate() (Options, error) {
+	if o.IdleTimeout == 0 {
+		o.IdleTimeout = DefaultIdleTimeout
+	}
+	if o.IdleTimeout < 0 || o.MaxLifetime < 0 || o.FreshFor < 0 {
+		return o, log.Wrapf(nil, "negative session duration")
+	}
+	if o.MaxLifetime > 0 && o.MaxLifetime < o.IdleTimeout {
+		return o, log.Wrapf(nil, "session max lifetime %v is shorter than idle timeout %v", o.MaxLifetime, o.IdleTimeout)
+	}
+	return o, nil
+} //Options.Validate()
+
+//Expiry is when a session that started at start expires if extended now
+func (o Options) Expiry(start time.Time) time.Time {
+	expire := time.Now().Add(o.IdleTimeout)
+	if o.MaxLifetime > 0 && expire.After(start.Add(o.MaxLifetime)) {
+		expire = start.Add(o.MaxLifetime)
+	}
+	return expire
+} //Options.Expiry()
+
+//Fresh is true when the session may be used for sensitive operations
+func (o Options) Fresh(s ISession) bool {
+	return s != nil && (o.FreshFor <= 0 || time.Since(s.Start()) <= o.FreshFor)
+} //Options.Fresh()
+
+//Client describes where a login comes from
+type Client struct {
+	Device    string //label chosen by the user, e.g. "office pc"
+	IP        string
+	UserAgent string
 }
 
 type ISession interface {
@@ -18,6 +132,7 @@ type ISession interface {
 	Start() time.Time
 	Expire() time.Time
 	User() users.IUser
+	Client() Client
 	Set(n string, v interface{})
 	Get(n string) (interface{}, bool)
 	Extend()
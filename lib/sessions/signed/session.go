@@ -0,0 +1,362 @@
+package signed
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+func init() {
+	sessions.Register("signed", func(mongoURI string, dbName string, users users.IUsers, opts sessions.Options) (sessions.ISessions, error) {
+		return New(users, opts, opts.Keys...)
+	})
+}
+
+//Key is an HMAC key used to sign session tokens, see sessions.Key
+type Key = sessions.Key
+
+//New sessions are HMAC signed tokens of the form
+//
+//	<key id>.<base64 claims>.<base64 signature>
+//
+//that carry the user id, start and expiry, so any server instance with
+//the keys can verify them without shared state
+//keys[0] signs new tokens, all keys verify, so to rotate, add the new
+//key in front and remove the old key once its tokens have expired
+//End(id) revokes a token in a small revocation list local to this
+//instance, that is kept only until the token expires
+//EndUser is also enforced only by this instance, so with several
+//instances behind a load balancer, other instances still accept the
+//ended tokens until they expire, SingleSession is refused for the
+//same reason
+//UserSessions cannot list tokens and returns sessions.ErrUnsupported
+//ExtendOnRead does not apply, because GetID cannot return a new token
+func New(users users.IUsers, opts sessions.Options, keys ...Key) (sessions.ISessions, error) {
+	if len(keys) == 0 {
+		return nil, log.Wrapf(nil, "signed sessions need at least one key")
+	}
+	byID := make(map[string]Key)
+	for _, k := range keys {
+		if len(k.ID) == 0 || strings.Contains(k.ID, ".") {
+			return nil, log.Wrapf(nil, "invalid session key id \"%s\"", k.ID)
+		}
+		if len(k.Secret) < 32 {
+			return nil, log.Wrapf(nil, "session key %s is shorter than 32 bytes", k.ID)
+		}
+		if _, ok := byID[k.ID]; ok {
+			return nil, log.Wrapf(nil, "duplicate session key %s", k.ID)
+		}
+		byID[k.ID] = k
+	}
+	opts, err := opts.Validate()
+	if err != nil {
+		return nil, log.Wrapf(err, "invalid session options")
+	}
+	if opts.SingleSession {
+		return nil, log.Wrapf(nil, "signed sessions do not support single session")
+	}
+	return &factory{
+		Hooks:     &sessions.Hooks{},
+		Lockout:   sessions.NewLockout(users),
+		users:     users,
+		opts:      opts,
+		signKey:   keys[0],
+		keys:      byID,
+		revoked:   make(map[string]int64),
+		userEnded: make(map[string]int64),
+	}, nil
+} //New()
+
+type factory struct {
+	*sessions.Hooks
+	*sessions.Lockout
+	users   users.IUsers
+	opts    sessions.Options
+	signKey Key
+	keys    map[string]Key
+
+	mutex     sync.Mutex
+	revoked   map[string]int64 //sid -> token expiry in unix seconds
+	userEnded map[string]int64 //user id -> unix nanoseconds of EndUser()
+}
+
+//claims are signed in the token
+type claims struct {
+	SID    string `json:"sid"` //random id used to revoke the token
+	UserID string `json:"uid"`
+	Start  int64  `json:"iat"` //unix nanoseconds, to order logins and EndUser()
+	Expire int64  `json:"exp"` //unix seconds
+
+	Device    string `json:"dev,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"ua,omitempty"`
+}
+
+func (f *factory) New(userID string, password string, client sessions.Client) (sessions.ISession, error) {
+	log.Debugf("Creating session for %s from %s", userID, client.IP)
+	attempt, err := f.Attempt(userID, client.IP)
+	if err != nil {
+		return nil, err
+	}
+	user, err := f.users.GetID(userID)
+	if err != nil {
+		return nil, &sessions.UsersError{Err: err}
+	}
+	if user == nil {
+		attempt.Fail()
+		return nil, log.Wrapf(nil, "unknown user")
+	}
+	if !user.Auth(password) {
+		attempt.Fail()
+		return nil, log.Wrapf(nil, "incorrect password")
+	}
+	attempt.Success()
+
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return nil, log.Wrapf(err, "failed to make session id")
+	}
+	now := time.Now()
+	s := &signedSession{
+		f: f,
+		claims: claims{
+			SID:       hex.EncodeToString(sid),
+			UserID:    user.ID(),
+			Start:     now.UnixNano(),
+			Device:    client.Device,
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+		},
+		user: user,
+		data: make(map[string]interface{}),
+	}
+	s.Extend()
+	log.Debugf("SESSION START: {sid:%s, user:%s}", s.claims.SID, user.ID())
+	f.Started(s)
+	return s, nil
+} //factory.New()
+
+//GetID verifies the token and returns the session
+//it does not extend the session, because that issues a new token
+func (f *factory) GetID(token string) sessions.ISession {
+	c, err := f.verify(token)
+	if err != nil {
+		log.Debugf("Invalid session token: %v", err)
+		return nil
+	}
+	user, err := f.users.GetID(c.UserID)
+	if err != nil {
+		log.Errorf("Failed to get user.id=%s of session: %v", c.UserID, err)
+		return nil
+	}
+	if user == nil {
+		log.Debugf("Session user.id=%s not found", c.UserID)
+		return nil
+	}
+	return &signedSession{
+		f:      f,
+		token:  token,
+		claims: c,
+		user:   user,
+		data:   make(map[string]interface{}),
+	}
+} //factory.GetID()
+
+func (f *factory) UserSessions(userID string) ([]sessions.ISession, error) {
+	return nil, sessions.ErrUnsupported
+} //factory.UserSessions()
+
+//EndUser rejects all tokens of the user issued up to now
+//OnEnd hooks are not called, because tokens are not tracked
+func (f *factory) EndUser(userID string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.userEnded[userID] = time.Now().UnixNano()
+	log.Debugf("SESSIONS ENDED: for user.id=%s", userID)
+} //factory.EndUser()
+
+func (f *factory) Options() sessions.Options {
+	return f.opts
+} //factory.Options()
+
+func (f *factory) IsValid(s sessions.ISession) bool {
+	if s == nil {
+		return false
+	}
+	_, err := f.verify(s.ID())
+	return err == nil
+} //factory.IsValid()
+
+//End revokes the token until it expires
+func (f *factory) End(token string) {
+	s := f.GetID(token)
+	if s == nil {
+		return
+	}
+	c := s.(*signedSession).claims
+	f.mutex.Lock()
+	f.revoked[c.SID] = c.Expire
+	f.mutex.Unlock()
+	log.Debugf("SESSION ENDED: {sid:%s, user:%s}", c.SID, c.UserID)
+	f.Ended(s)
+} //factory.End()
+
+//StartReaper removes expired tokens from the revocation list
+//OnExpire hooks are never called, because tokens are not tracked
+func (f *factory) StartReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debugf("Session reaper stopped")
+				return
+			case <-t.C:
+				f.reap()
+			}
+		}
+	}()
+} //factory.StartReaper()
+
+func (f *factory) reap() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	for sid, exp := range f.revoked {
+		if exp < now.Unix() {
+			delete(f.revoked, sid)
+		}
+	}
+	for userID, ended := range f.userEnded {
+		//tokens issued before this cannot still be valid
+		if time.Unix(0, ended).Add(f.maxAge()).Before(now) {
+			delete(f.userEnded, userID)
+		}
+	}
+} //factory.reap()
+
+//maxAge is the longest a token can be valid after it was issued
+func (f *factory) maxAge() time.Duration {
+	if f.opts.MaxLifetime > 0 {
+		return f.opts.MaxLifetime
+	}
+	//without a max lifetime, tokens can be extended forever
+	return 365 * 24 * time.Hour
+} //factory.maxAge()
+
+func (f *factory) sign(c claims) string {
+	j, _ := json.Marshal(c)
+	signed := f.signKey.ID + "." + base64.RawURLEncoding.EncodeToString(j)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac(f.signKey, signed))
+} //factory.sign()
+
+func (f *factory) verify(token string) (claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims{}, log.Wrapf(nil, "malformed token")
+	}
+	key, ok := f.keys[parts[0]]
+	if !ok {
+		return claims{}, log.Wrapf(nil, "unknown key %s", parts[0])
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac(key, parts[0]+"."+parts[1])) {
+		return claims{}, log.Wrapf(nil, "invalid signature")
+	}
+	j, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims{}, log.Wrapf(err, "malformed claims")
+	}
+	var c claims
+	if err := json.Unmarshal(j, &c); err != nil {
+		return claims{}, log.Wrapf(err, "malformed claims")
+	}
+	if time.Now().Unix() >= c.Expire {
+		return claims{}, log.Wrapf(nil, "expired at %v", time.Unix(c.Expire, 0))
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, revoked := f.revoked[c.SID]; revoked {
+		return claims{}, log.Wrapf(nil, "revoked")
+	}
+	if ended, ok := f.userEnded[c.UserID]; ok && c.Start <= ended {
+		return claims{}, log.Wrapf(nil, "all sessions of user ended")
+	}
+	return c, nil
+} //factory.verify()
+
+func mac(k Key, s string) []byte {
+	h := hmac.New(sha256.New, k.Secret)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+} //mac()
+
+//signedSession implements ISession
+//the session id is the token, which changes when the session is extended
+//Set/Get data is not in the token and only lasts for this session value
+type signedSession struct {
+	f      *factory
+	token  string
+	claims claims
+	user   users.IUser
+	mutex  sync.Mutex
+	data   map[string]interface{}
+}
+
+func (s *signedSession) ID() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token
+}
+
+func (s *signedSession) Start() time.Time {
+	return time.Unix(0, s.claims.Start)
+}
+
+func (s *signedSession) Expire() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Unix(s.claims.Expire, 0)
+}
+
+func (s *signedSession) User() users.IUser {
+	return s.user
+}
+
+func (s *signedSession) Client() sessions.Client {
+	return sessions.Client{Device: s.claims.Device, IP: s.claims.IP, UserAgent: s.claims.UserAgent}
+}
+
+func (s *signedSession) Set(n string, v interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[n] = v
+}
+
+func (s *signedSession) Get(n string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.data[n]
+	return v, ok
+}
+
+//Extend issues a new token with a later expiry and the same sid, so that
+//End() of either token revokes both
+func (s *signedSession) Extend() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.claims.Expire = s.f.opts.Expiry(time.Unix(0, s.claims.Start)).Unix()
+	s.token = s.f.sign(s.claims)
+}
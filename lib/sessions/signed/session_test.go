@@ -0,0 +1,141 @@
+package signed_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/sessions/signed"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/users/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	k1 = signed.Key{ID: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}
+	k2 = signed.Key{ID: "k2", Secret: []byte("fedcba9876543210fedcba9876543210")}
+)
+
+func newUsers(t *testing.T) (users.IUsers, users.IUser) {
+	users.PasswordCost = bcrypt.MinCost
+	us, err := memory.Users()
+	if err != nil {
+		t.Fatalf("failed to make users: %v", err)
+	}
+	u, err := us.New("27821234567", "one", "1234")
+	if err != nil {
+		t.Fatalf("failed to make user: %v", err)
+	}
+	return us, u
+}
+
+func TestLoginEnd(t *testing.T) {
+	us, u := newUsers(t)
+	f, err := signed.New(us, sessions.DefaultOptions(), k1)
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	started, ended := 0, 0
+	f.OnStart(func(sessions.ISession) { started++ })
+	f.OnEnd(func(sessions.ISession) { ended++ })
+
+	if _, err := f.New(u.ID(), "0000", sessions.Client{}); err == nil {
+		t.Fatalf("login with wrong password")
+	}
+	s, err := f.New(u.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if started != 1 {
+		t.Fatalf("OnStart called %d times", started)
+	}
+	token := s.ID()
+	if got := f.GetID(token); got == nil || got.User().ID() != u.ID() || !f.IsValid(got) {
+		t.Fatalf("token does not verify")
+	}
+
+	f.End(token)
+	if ended != 1 {
+		t.Fatalf("OnEnd called %d times", ended)
+	}
+	if f.GetID(token) != nil || f.IsValid(s) {
+		t.Fatalf("ended token still valid")
+	}
+}
+
+//TestKeyRotation checks that tokens signed with an older key verify
+//while it is still listed after the new key, and not once it is removed
+func TestKeyRotation(t *testing.T) {
+	us, u := newUsers(t)
+	old, err := signed.New(us, sessions.DefaultOptions(), k1)
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	s, err := old.New(u.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+
+	rotated, err := signed.New(us, sessions.DefaultOptions(), k2, k1)
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	if got := rotated.GetID(s.ID()); got == nil || got.User().ID() != u.ID() {
+		t.Fatalf("token of old key does not verify after rotation")
+	}
+	s2, err := rotated.New(u.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if !strings.HasPrefix(s2.ID(), k2.ID+".") {
+		t.Fatalf("new token not signed with the new key: %s", s2.ID())
+	}
+	if old.GetID(s2.ID()) != nil {
+		t.Fatalf("token of new key verifies without the key")
+	}
+
+	removed, err := signed.New(us, sessions.DefaultOptions(), k2)
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	if removed.GetID(s.ID()) != nil {
+		t.Fatalf("token of removed key still verifies")
+	}
+	if removed.GetID(s2.ID()) == nil {
+		t.Fatalf("token of new key does not verify")
+	}
+}
+
+//TestEndUser checks that a login right after EndUser, in the same
+//second, is still valid
+func TestEndUser(t *testing.T) {
+	us, u := newUsers(t)
+	f, err := signed.New(us, sessions.DefaultOptions(), k1)
+	if err != nil {
+		t.Fatalf("failed to make sessions: %v", err)
+	}
+	before, err := f.New(u.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	f.EndUser(u.ID())
+	after, err := f.New(u.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if f.GetID(before.ID()) != nil {
+		t.Fatalf("token from before EndUser still valid")
+	}
+	if f.GetID(after.ID()) == nil {
+		t.Fatalf("token from after EndUser not valid")
+	}
+	if _, err := f.UserSessions(u.ID()); err != sessions.ErrUnsupported {
+		t.Fatalf("UserSessions returned %v", err)
+	}
+
+	opts := sessions.DefaultOptions()
+	opts.SingleSession = true
+	if _, err := signed.New(us, opts, k1); err == nil {
+		t.Fatalf("single session accepted")
+	}
+}
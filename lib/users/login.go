@@ -0,0 +1,14 @@
+package users
+
+import (
+	"time"
+)
+
+//LoginAttempts are the failed logins of a user, kept in the users store
+//so that delays and locks hold across restarts and server instances
+type LoginAttempts struct {
+	Failures int       //failed logins in a row
+	Last     time.Time //time of the last failure
+	Until    time.Time //no login is allowed before this time
+	Locked   bool      //no login until unlocked
+}
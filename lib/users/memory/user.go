@@ -2,12 +2,19 @@ package memory
 
 import (
 	"sync"
+	"time"
 
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/users"
 	"github.com/satori/uuid"
 )
 
+func init() {
+	users.Register("memory", func(mongoURI string, dbName string) (users.IUsers, error) {
+		return Users()
+	})
+}
+
 func Users() (users.IUsers, error) {
 	return &factory{
 		mutex:    sync.Mutex{},
@@ -17,41 +24,69 @@ func Users() (users.IUsers, error) {
 }
 
 //memoryUser implements IUser
+//password, roles and login attempts are guarded by mutex
 type memoryUser struct {
-	id       string
-	msisdn   string
-	name     string
-	password string
+	id     string
+	msisdn string
+	name   string
+
+	mutex    sync.Mutex
+	password string //bcrypt hash
+	roles    []users.Role
+	login    users.LoginAttempts
 }
 
-func (u memoryUser) ID() string {
+func (u *memoryUser) ID() string {
 	return u.id
 }
 
-func (u memoryUser) Msisdn() string {
+func (u *memoryUser) Msisdn() string {
 	return u.msisdn
 }
 
-func (u memoryUser) Name() string {
+func (u *memoryUser) Name() string {
 	return u.name
 }
 
-func (u memoryUser) Auth(password string) bool {
-	if u.password == password {
-		return true
-	}
-	return false
+func (u *memoryUser) Auth(password string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	ok, _ := users.CheckPassword(u.password, password)
+	return ok
 }
 
 func (u *memoryUser) SetPassword(oldPassword, newPassword string) error {
-	if u.password != oldPassword {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if ok, _ := users.CheckPassword(u.password, oldPassword); !ok {
 		return log.Wrapf(nil, "Incorrect old password")
 	}
 	p, err := users.ValidatePassword(newPassword)
 	if err != nil {
 		return log.Wrapf(nil, "Cannot set invalid password")
 	}
-	u.password = p
+	h, err := users.HashPassword(p)
+	if err != nil {
+		return err
+	}
+	u.password = h
+	return nil
+}
+
+func (u *memoryUser) Roles() []users.Role {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]users.Role{}, u.roles...)
+}
+
+func (u *memoryUser) SetRoles(roles ...users.Role) error {
+	r, err := users.ValidateRoles(roles)
+	if err != nil {
+		return log.Wrapf(err, "Cannot set invalid roles")
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.roles = r
 	return nil
 }
 
@@ -85,12 +120,17 @@ func (f *factory) New(msisdn, name, password string) (users.IUser, error) {
 	if _, ok := f.byMsisdn[m]; ok {
 		return nil, log.Wrapf(nil, "user.msisdn=\"%s\" already exists.", m)
 	}
+	h, err := users.HashPassword(p)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot create user")
+	}
 
 	u := &memoryUser{
 		id:       uuid.NewV1().String(),
 		msisdn:   m,
 		name:     n,
-		password: p,
+		password: h,
+		roles:    []users.Role{users.DefaultRole},
 	}
 
 	if _, ok := f.byID[u.id]; ok {
@@ -100,37 +140,86 @@ func (f *factory) New(msisdn, name, password string) (users.IUser, error) {
 	f.byID[u.id] = u
 	f.byMsisdn[u.msisdn] = u
 
-	{
-		log.Debugf("USER CREATED:{id:%s,msisdn:%s,name:%s}",
-			u.id,
-			u.msisdn,
-			u.name)
-		log.Debugf("Now %d users:", len(f.byID))
-		for _, user := range f.byID {
-			log.Debugf("{id:%s,msisdn:%s,name:%s}", user.ID(), user.Msisdn(), user.Name())
-		}
-	}
+	log.Debugf("USER CREATED:{id:%s,msisdn:%s,name:%s}",
+		u.id,
+		u.msisdn,
+		u.name)
 	return u, nil
 } //factory.New()
 
-func (f *factory) GetMsisdn(m string) users.IUser {
+func (f *factory) GetMsisdn(m string) (users.IUser, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	if u, ok := f.byMsisdn[m]; ok {
-		return u
+		return u, nil
 	}
-	log.Debugf("User not found among %d users", len(f.byMsisdn))
-	for m, u := range f.byMsisdn {
-		log.Debugf("  %s: %v", m, u)
-	}
-	return nil
+	return nil, nil
 } //factory.GetMsisdn()
 
-func (f *factory) GetID(id string) users.IUser {
+func (f *factory) GetID(id string) (users.IUser, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 	if u, ok := f.byID[id]; ok {
-		return u
+		return u, nil
 	}
-	return nil
+	return nil, nil
 } //factory.GetID()
+
+//user returns the user with the id, or nil
+func (f *factory) user(id string) *memoryUser {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if u, ok := f.byID[id]; ok {
+		return u.(*memoryUser)
+	}
+	return nil
+} //factory.user()
+
+func (f *factory) LoginAttempts(userID string) (users.LoginAttempts, error) {
+	u := f.user(userID)
+	if u == nil {
+		return users.LoginAttempts{}, nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.login, nil
+} //factory.LoginAttempts()
+
+func (f *factory) FailLogin(userID string, at time.Time, forget time.Time) (users.LoginAttempts, error) {
+	u := f.user(userID)
+	if u == nil {
+		return users.LoginAttempts{}, nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if !u.login.Locked && u.login.Last.Before(forget) {
+		u.login = users.LoginAttempts{}
+	}
+	u.login.Failures++
+	u.login.Last = at
+	return u.login, nil
+} //factory.FailLogin()
+
+func (f *factory) DelayLogin(userID string, until time.Time, lock bool) error {
+	u := f.user(userID)
+	if u == nil {
+		return log.Wrapf(nil, "unknown user.id=%s", userID)
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.login.Until = until
+	u.login.Locked = u.login.Locked || lock
+	return nil
+} //factory.DelayLogin()
+
+func (f *factory) ClearLogins(userID string) (users.LoginAttempts, error) {
+	u := f.user(userID)
+	if u == nil {
+		return users.LoginAttempts{}, nil
+	}
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	cleared := u.login
+	u.login = users.LoginAttempts{}
+	return cleared, nil
+} //factory.ClearLogins()
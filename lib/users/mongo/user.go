@@ -12,6 +12,10 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func init() {
+	users.Register("mongo", Users)
+}
+
 //e.g. Users("mongodb://localhost:27017", "taxiching")
 func Users(mongoURI string, dbName string) (users.IUsers, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
@@ -33,17 +37,51 @@ func Users(mongoURI string, dbName string) (users.IUsers, error) {
 	// }
 
 	collection := client.Database(dbName).Collection("users")
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "msisdn", Value: 1}}, Options: options.Index().SetUnique(true)},
+	}); err != nil {
+		return nil, log.Wrapf(err, "Failed to create user indexes (remove duplicate users first)")
+	}
+
 	return &factory{
 		collection: collection,
 	}, nil
 } //Users()
 
+//userDoc is the stored form of a user
+type userDoc struct {
+	ID       string       `bson:"id"`
+	Msisdn   string       `bson:"msisdn"`
+	Name     string       `bson:"name"`
+	Password string       `bson:"password"` //bcrypt hash, plain text in legacy records
+	Roles    []users.Role `bson:"roles,omitempty"`
+	//Login has the failed logins, see sessions.Lockout
+	Login *loginDoc `bson:"login,omitempty"`
+}
+
+type loginDoc struct {
+	Failures int       `bson:"failures"`
+	Last     time.Time `bson:"last"`
+	Until    time.Time `bson:"until"`
+	Locked   bool      `bson:"locked"`
+}
+
+func (d *loginDoc) attempts() users.LoginAttempts {
+	if d == nil {
+		return users.LoginAttempts{}
+	}
+	return users.LoginAttempts{Failures: d.Failures, Last: d.Last, Until: d.Until, Locked: d.Locked}
+} //loginDoc.attempts()
+
 //mongoUser implements IUser
 type mongoUser struct {
-	id       string
-	msisdn   string
-	name     string
-	password string
+	collection *mongo.Collection
+	id         string
+	msisdn     string
+	name       string
+	password   string
+	roles      []users.Role
 }
 
 func (u mongoUser) ID() string {
@@ -58,25 +96,83 @@ func (u mongoUser) Name() string {
 	return u.name
 }
 
-func (u mongoUser) Auth(password string) bool {
-	if u.password == password {
-		return true
+//Auth checks the password and replaces a legacy plain text password
+//or weaker hash with a new hash after a successful login
+func (u *mongoUser) Auth(password string) bool {
+	ok, rehash := users.CheckPassword(u.password, password)
+	if ok && rehash {
+		if err := u.rehash(password); err != nil {
+			log.Errorf("Failed to rehash password of user.id=%s: %v", u.id, err)
+		}
 	}
-	return false
+	return ok
+}
+
+func (u *mongoUser) rehash(password string) error {
+	h, err := users.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	//only replace what was checked, in case the password changed meanwhile
+	if _, err := u.collection.UpdateOne(ctx, bson.M{"id": u.id, "password": u.password}, bson.M{"$set": bson.M{"password": h}}); err != nil {
+		return log.Wrapf(err, "failed to store password hash")
+	}
+	log.Debugf("Rehashed password of user.id=%s", u.id)
+	u.password = h
+	return nil
 }
 
 func (u *mongoUser) SetPassword(oldPassword, newPassword string) error {
-	if u.password != oldPassword {
+	if ok, _ := users.CheckPassword(u.password, oldPassword); !ok {
 		return log.Wrapf(nil, "Incorrect old password")
 	}
 	p, err := users.ValidatePassword(newPassword)
 	if err != nil {
 		return log.Wrapf(nil, "Cannot set invalid password")
 	}
+	p, err = users.HashPassword(p)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := u.collection.UpdateOne(ctx, bson.M{"id": u.id}, bson.M{"$set": bson.M{"password": p}})
+	if err != nil {
+		return log.Wrapf(err, "failed to store password")
+	}
+	if res.MatchedCount == 0 {
+		return log.Wrapf(nil, "user.id=%s not found", u.id)
+	}
 	u.password = p
 	return nil
 }
 
+func (u mongoUser) Roles() []users.Role {
+	return append([]users.Role{}, u.roles...)
+}
+
+func (u *mongoUser) SetRoles(roles ...users.Role) error {
+	r, err := users.ValidateRoles(roles)
+	if err != nil {
+		return log.Wrapf(err, "Cannot set invalid roles")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := u.collection.UpdateOne(ctx, bson.M{"id": u.id}, bson.M{"$set": bson.M{"roles": r}})
+	if err != nil {
+		return log.Wrapf(err, "failed to store roles")
+	}
+	if res.MatchedCount == 0 {
+		return log.Wrapf(nil, "user.id=%s not found", u.id)
+	}
+	u.roles = r
+	return nil
+}
+
 type factory struct {
 	collection *mongo.Collection
 }
@@ -99,97 +195,154 @@ func (f factory) New(msisdn, name, password string) (users.IUser, error) {
 	}
 
 	//make sure msisdn is uniq
-	if f.GetMsisdn(m) != nil {
+	existing, err := f.GetMsisdn(m)
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot create user")
+	}
+	if existing != nil {
 		return nil, log.Wrapf(nil, "User already exists with msisdn=%s", m)
 	}
 
-	id := uuid.NewV1().String()
-	_, err = f.collection.InsertOne(
-		ctx,
-		bson.M{
-			"id":       id,
-			"msisdn":   m,
-			"name":     n,
-			"password": p,
-		})
+	h, err := users.HashPassword(p)
 	if err != nil {
-		return nil, log.Wrapf(err, "failed to insert user into db")
+		return nil, log.Wrapf(err, "cannot create user")
 	}
-	u := &mongoUser{
-		id:       id,
-		msisdn:   msisdn,
-		name:     name,
-		password: password,
+
+	doc := userDoc{
+		ID:       uuid.NewV1().String(),
+		Msisdn:   m,
+		Name:     n,
+		Password: h,
+		Roles:    []users.Role{users.DefaultRole},
 	}
-	return u, nil
+	if _, err = f.collection.InsertOne(ctx, doc); err != nil {
+		if isDuplicateKey(err) {
+			//lost a race with a concurrent registration
+			return nil, log.Wrapf(nil, "User already exists with msisdn=%s", m)
+		}
+		return nil, log.Wrapf(err, "failed to insert user into db")
+	}
+	return f.user(doc), nil
 } //factory.New()
 
-func (f factory) GetMsisdn(msisdn string) users.IUser {
+func (f factory) GetMsisdn(msisdn string) (users.IUser, error) {
+	return f.findOne(bson.M{"msisdn": msisdn})
+} //factory.GetMsisdn()
+
+func (f factory) GetID(id string) (users.IUser, error) {
+	return f.findOne(bson.M{"id": id})
+} //factory.GetID()
+
+//findOne returns the user matching the filter, or nil when not found
+func (f factory) findOne(filter bson.M) (users.IUser, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cur, err := f.collection.Find(ctx, bson.M{"msisdn": msisdn})
-	if err != nil {
-		log.Errorf("Failed to find msisdn: %v", err)
-		return nil
+	var doc userDoc
+	if err := f.collection.FindOne(ctx, filter).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, log.Wrapf(err, "failed to find user")
 	}
-	defer cur.Close(ctx)
+	return f.user(doc), nil
+} //factory.findOne()
 
-	for cur.Next(ctx) {
-		var result bson.M
-		err := cur.Decode(&result)
-		if err != nil {
-			log.Errorf("Failed to get data: %v", err)
-			return nil
-		}
-		// do something with result....
-		log.Debugf("GOT (%T): %+v", result, result)
-		u := mongoUser{
-			id:       result["id"].(string),
-			name:     result["name"].(string),
-			msisdn:   result["msisdn"].(string),
-			password: result["password"].(string),
-		}
-		return &u
+//user makes the user from the stored doc
+//users stored before roles were added get the default role
+func (f factory) user(doc userDoc) *mongoUser {
+	if len(doc.Roles) == 0 {
+		doc.Roles = []users.Role{users.DefaultRole}
 	}
-	if err := cur.Err(); err != nil {
-		log.Errorf("Error: %v", err)
-		return nil
+	return &mongoUser{
+		collection: f.collection,
+		id:         doc.ID,
+		msisdn:     doc.Msisdn,
+		name:       doc.Name,
+		password:   doc.Password,
+		roles:      doc.Roles,
 	}
-	return nil
-} //factory.GetMsisdn()
+} //factory.user()
 
-func (f factory) GetID(id string) users.IUser {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (f factory) LoginAttempts(userID string) (users.LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	var doc userDoc
+	if err := f.collection.FindOne(ctx, bson.M{"id": userID}, options.FindOne().SetProjection(bson.M{"login": 1})).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return users.LoginAttempts{}, nil
+		}
+		return users.LoginAttempts{}, log.Wrapf(err, "failed to get login attempts")
+	}
+	return doc.Login.attempts(), nil
+} //factory.LoginAttempts()
+
+//FailLogin counts the failure in the db, so that concurrent failures on
+//several server instances all count
+func (f factory) FailLogin(userID string, at time.Time, forget time.Time) (users.LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := f.collection.UpdateOne(ctx,
+		bson.M{"id": userID, "login.locked": bson.M{"$ne": true}, "login.last": bson.M{"$lt": forget}},
+		bson.M{"$unset": bson.M{"login": ""}}); err != nil {
+		return users.LoginAttempts{}, log.Wrapf(err, "failed to forget login failures")
+	}
+	var doc userDoc
+	if err := f.collection.FindOneAndUpdate(ctx,
+		bson.M{"id": userID},
+		bson.M{"$inc": bson.M{"login.failures": 1}, "$set": bson.M{"login.last": at}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"login": 1}),
+	).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return users.LoginAttempts{}, nil
+		}
+		return users.LoginAttempts{}, log.Wrapf(err, "failed to count login failure")
+	}
+	return doc.Login.attempts(), nil
+} //factory.FailLogin()
 
-	cur, err := f.collection.Find(ctx, bson.M{"id": id})
+func (f factory) DelayLogin(userID string, until time.Time, lock bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	set := bson.M{"login.until": until}
+	if lock {
+		set["login.locked"] = true
+	}
+	res, err := f.collection.UpdateOne(ctx, bson.M{"id": userID}, bson.M{"$set": set})
 	if err != nil {
-		log.Errorf("Failed to find id: %v", err)
-		return nil
+		return log.Wrapf(err, "failed to delay login")
 	}
-	defer cur.Close(ctx)
+	if res.MatchedCount == 0 {
+		return log.Wrapf(nil, "user.id=%s not found", userID)
+	}
+	return nil
+} //factory.DelayLogin()
 
-	for cur.Next(ctx) {
-		var result bson.M
-		err := cur.Decode(&result)
-		if err != nil {
-			log.Errorf("Failed to get data: %v", err)
-			return nil
-		}
-		// do something with result....
-		log.Debugf("GOT (%T): %+v", result, result)
-		u := mongoUser{
-			id:       result["id"].(string),
-			name:     result["name"].(string),
-			msisdn:   result["msisdn"].(string),
-			password: result["password"].(string),
+func (f factory) ClearLogins(userID string) (users.LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc userDoc
+	if err := f.collection.FindOneAndUpdate(ctx,
+		bson.M{"id": userID, "login": bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"login": ""}},
+		options.FindOneAndUpdate().SetProjection(bson.M{"login": 1}),
+	).Decode(&doc); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return users.LoginAttempts{}, nil
 		}
-		return &u
+		return users.LoginAttempts{}, log.Wrapf(err, "failed to clear login failures")
 	}
-	if err := cur.Err(); err != nil {
-		log.Errorf("Error: %v", err)
-		return nil
+	return doc.Login.attempts(), nil
+} //factory.ClearLogins()
+
+//isDuplicateKey is true when a unique index refused the write
+func isDuplicateKey(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
 	}
-	return nil
-} //factory.GetID()
+	return false
+} //isDuplicateKey()
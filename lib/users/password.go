@@ -0,0 +1,43 @@
+package users
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/jansemmelink/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//PasswordCost is the bcrypt cost used for new hashes
+var PasswordCost = bcrypt.DefaultCost
+
+//HashPassword returns a salted bcrypt hash of the password
+//backends store only this hash, never the password
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), PasswordCost)
+	if err != nil {
+		return "", log.Wrapf(err, "failed to hash password")
+	}
+	return string(h), nil
+} //HashPassword()
+
+//CheckPassword compares a password with the stored hash
+//records created before hashing was introduced hold the plain text
+//password, which is compared in constant time and reported with
+//rehash=true so the caller can replace it with a hash
+func CheckPassword(stored string, password string) (ok bool, rehash bool) {
+	if !IsPasswordHash(stored) {
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err == nil && cost < PasswordCost
+} //CheckPassword()
+
+//IsPasswordHash is false for legacy plain text passwords
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+} //IsPasswordHash()
@@ -0,0 +1,24 @@
+package users
+
+import (
+	"github.com/jansemmelink/taxiching/lib/registry"
+)
+
+//Backend opens users in a store
+type Backend func(mongoURI string, dbName string) (IUsers, error)
+
+var backends = registry.New("users")
+
+//Register makes the users backend available by name
+func Register(name string, b Backend) {
+	backends.Add(name, b)
+} //Register()
+
+//Open users with the named backend
+func Open(name string, mongoURI string, dbName string) (IUsers, error) {
+	b, err := backends.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Backend)(mongoURI, dbName)
+} //Open()
@@ -0,0 +1,90 @@
+package users
+
+import (
+	"github.com/jansemmelink/log"
+)
+
+//Role of a user, which decides what the user is allowed to do
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleTeller    Role = "teller"
+	RoleTaxiOwner Role = "taxi-owner"
+	RoleDriver    Role = "driver"
+	RolePassenger Role = "passenger"
+)
+
+//DefaultRole is given to new users, and to stored users without roles
+const DefaultRole = RolePassenger
+
+//Permission to do an operation
+type Permission string
+
+const (
+	PermSend        Permission = "send"         //send money from own wallets
+	PermSellGoods   Permission = "sell-goods"   //list goods for sale
+	PermDeposit     Permission = "deposit"      //load EFT deposits from the bank wallet
+	PermConvert     Permission = "convert"      //convert own wallets between currencies at a supplied rate
+	PermRefundAny   Permission = "refund-any"   //refund a payment received by another user
+	PermUnlockUser  Permission = "unlock-user"  //unlock a user after failed logins
+	PermVerify      Permission = "verify"       //check the ledger
+	PermManageRoles Permission = "manage-roles" //change the roles of users
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin:     {PermSend, PermSellGoods, PermDeposit, PermConvert, PermRefundAny, PermUnlockUser, PermVerify, PermManageRoles},
+	RoleTeller:    {PermSend, PermDeposit, PermConvert, PermUnlockUser},
+	RoleTaxiOwner: {PermSend, PermSellGoods},
+	RoleDriver:    {PermSend, PermSellGoods},
+	RolePassenger: {PermSend},
+}
+
+//Can is true when one of the user's roles has the permission
+func Can(u IUser, p Permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, r := range u.Roles() {
+		for _, rp := range rolePermissions[r] {
+			if rp == p {
+				return true
+			}
+		}
+	}
+	return false
+} //Can()
+
+//HasRole is true when the user has the role
+func HasRole(u IUser, role Role) bool {
+	if u == nil {
+		return false
+	}
+	for _, r := range u.Roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+} //HasRole()
+
+//ValidateRoles checks that all roles are known and removes duplicates
+func ValidateRoles(roles []Role) ([]Role, error) {
+	if len(roles) == 0 {
+		return nil, log.Wrapf(nil, "user must have a role")
+	}
+	valid := make([]Role, 0, len(roles))
+	for _, r := range roles {
+		if _, ok := rolePermissions[r]; !ok {
+			return nil, log.Wrapf(nil, "unknown role \"%s\"", r)
+		}
+		dup := false
+		for _, v := range valid {
+			dup = dup || v == r
+		}
+		if !dup {
+			valid = append(valid, r)
+		}
+	}
+	return valid, nil
+} //ValidateRoles()
@@ -3,6 +3,7 @@ package users
 import (
 	"regexp"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/jansemmelink/log"
@@ -14,26 +15,38 @@ type IUser interface {
 	Name() string
 	Auth(password string) bool
 	SetPassword(oldPassword, newPassword string) error
+	//Roles decide what the user may do, see Can()
+	Roles() []Role
+	SetRoles(roles ...Role) error
 	//Profile() image
 }
 
+// IUsers is the store of users
+// GetMsisdn and GetID return nil without an error when the user does not
+// exist, and an error when the store failed
 type IUsers interface {
 	New(msisdn, name, password string) (IUser, error)
-	GetMsisdn(msisdn string) IUser
-	GetID(id string) IUser
-}
+	GetMsisdn(msisdn string) (IUser, error)
+	GetID(id string) (IUser, error)
 
-// func Register(f IUserFactory) {
-// 	if factory != nil {
-// 		panic(log.Wrapf(nil, "Multiple user factories registered. First was %T", factory))
-// 	}
-// 	factory = f
-// }
+	//LoginAttempts returns the failed logins of the user, none for an
+	//unknown user
+	LoginAttempts(userID string) (LoginAttempts, error)
+	//FailLogin counts a failed login at the given time and returns the
+	//new attempts, failures before forget are cleared first unless the
+	//user is locked
+	FailLogin(userID string, at time.Time, forget time.Time) (LoginAttempts, error)
+	//DelayLogin refuses logins of the user until the given time, and
+	//until unlocked when lock is true
+	DelayLogin(userID string, until time.Time, lock bool) error
+	//ClearLogins removes the failures and lock of the user and returns
+	//what was cleared
+	ClearLogins(userID string) (LoginAttempts, error)
+}
 
 var (
 	msisdnPattern = regexp.MustCompile(`^27[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]$`)
 	namePattern   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9@_\.-]*[a-zA-Z0-9]$`)
-	// factory IUserFactory
 )
 
 func ValidatePassword(password string) (string, error) {
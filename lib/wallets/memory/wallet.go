@@ -10,6 +10,12 @@ import (
 	"github.com/satori/uuid"
 )
 
+func init() {
+	wallets.Register("memory", func(mongoURI string, dbName string, users users.IUsers) (wallets.IWallets, error) {
+		return New(users)
+	})
+}
+
 func New(users users.IUsers) (wallets.IWallets, error) {
 	return &factory{
 		users:    users,
@@ -29,13 +35,17 @@ type factory struct {
 	byDepRef    map[string]wallets.IWallet
 }
 
-func (f *factory) New(u users.IUser, walletName string, minBalance wallets.Amount) (wallets.IWallet, error) {
+func (f *factory) New(u users.IUser, walletName string, minBalance wallets.Money) (wallets.IWallet, error) {
 	if f == nil {
 		return nil, log.Wrapf(nil, "no wallet factory registered")
 	}
 	if len(walletName) < 1 {
 		return nil, log.Wrapf(nil, "missing wallet name")
 	}
+	currency, err := wallets.ValidateCurrency(string(minBalance.Currency))
+	if err != nil {
+		return nil, log.Wrapf(err, "cannot create wallet with invalid currency")
+	}
 
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
@@ -50,8 +60,8 @@ func (f *factory) New(u users.IUser, walletName string, minBalance wallets.Amoun
 		id:         uuid.NewV1().String(),
 		owner:      u,
 		name:       walletName,
-		balance:    0,
-		minBalance: minBalance,
+		balance:    wallets.NewMoney(currency, 0),
+		minBalance: wallets.NewMoney(currency, minBalance.Units),
 	}
 	if _, ok := f.byID[w.id]; ok {
 		return nil, log.Wrapf(nil, "duplicate wallet.id=%s created", w.id)
@@ -61,7 +71,7 @@ func (f *factory) New(u users.IUser, walletName string, minBalance wallets.Amoun
 		f.byUserID[w.Owner().ID()] = make(map[string]wallets.IWallet)
 	}
 	f.byUserID[w.Owner().ID()][walletName] = w
-	w.depRef, _ = f.NewDepRef(w)
+	f.NewDepRef(w)
 	return w, nil
 } //factory.New()
 
@@ -79,44 +89,72 @@ func (f *factory) UserWallet(userID string, walletName string) wallets.IWallet {
 	return nil
 } //factory.UserWallet()
 
+func (f *factory) GetID(id string) wallets.IWallet {
+	if f == nil {
+		return nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if w, ok := f.byID[id]; ok {
+		return w
+	}
+	return nil
+} //factory.GetID()
+
+//memoryWallet is safe for concurrent use, balance and depRef are
+//guarded by mutex
 type memoryWallet struct {
 	id         string
 	owner      users.IUser
 	name       string
-	depRef     string
-	balance    wallets.Amount
-	minBalance wallets.Amount
+	minBalance wallets.Money
+
+	mutex   sync.Mutex
+	depRef  string
+	balance wallets.Money
 }
 
-func (w memoryWallet) ID() string {
+func (w *memoryWallet) ID() string {
 	return w.id
 }
 
-func (w memoryWallet) Owner() users.IUser {
+func (w *memoryWallet) Owner() users.IUser {
 	return w.owner
 }
 
-func (w memoryWallet) Name() string {
+func (w *memoryWallet) Name() string {
 	return w.name
 }
 
-func (w memoryWallet) Balance() wallets.Amount {
+func (w *memoryWallet) Currency() wallets.Currency {
+	return w.minBalance.Currency
+}
+
+func (w *memoryWallet) Balance() wallets.Money {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	return w.balance
 }
 
-func (w memoryWallet) MinBalance() wallets.Amount {
+func (w *memoryWallet) MinBalance() wallets.Money {
 	return w.minBalance
 }
 
-func (w *memoryWallet) Debit(amount wallets.Amount) {
-	w.balance -= amount
+func (w *memoryWallet) Debit(amount wallets.Money) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.balance.Units -= amount.Units
 }
 
-func (w *memoryWallet) Credit(amount wallets.Amount) {
-	w.balance += amount
+func (w *memoryWallet) Credit(amount wallets.Money) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.balance.Units += amount.Units
 }
 
 func (w *memoryWallet) DepositReference() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	return w.depRef
 }
 
@@ -130,18 +168,23 @@ func (f *factory) NewDepRef(w wallets.IWallet) (string, error) {
 	defer f.depRefMutex.Unlock()
 	for attempt := 0; attempt < 10; attempt++ {
 		ref := "W-"
-		ref += string('0' + rand.Intn(10))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
+		ref += string(rune('0' + rand.Intn(10)))
+		ref += string(rune('A' + rand.Intn(26)))
+		ref += string(rune('A' + rand.Intn(26)))
+		ref += string(rune('A' + rand.Intn(26)))
 		ref += "-"
-		ref += string('0' + rand.Intn(10))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
+		ref += string(rune('0' + rand.Intn(10)))
+		ref += string(rune('A' + rand.Intn(26)))
+		ref += string(rune('A' + rand.Intn(26)))
+		ref += string(rune('A' + rand.Intn(26)))
 		if _, ok := f.byDepRef[ref]; !ok {
 			//found unique dep ref id
 			f.byDepRef[ref] = w
+			if mw, ok := w.(*memoryWallet); ok {
+				mw.mutex.Lock()
+				mw.depRef = ref
+				mw.mutex.Unlock()
+			}
 			return ref, nil
 		} //if found
 	} //for each attempt
@@ -158,5 +201,11 @@ func (f *factory) GetByDepRef(ref string) wallets.IWallet {
 }
 
 func (f *factory) All() map[string]wallets.IWallet {
-	return f.byID
-}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	all := make(map[string]wallets.IWallet, len(f.byID))
+	for id, w := range f.byID {
+		all[id] = w
+	}
+	return all
+} //factory.All()
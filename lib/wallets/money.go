@@ -0,0 +1,178 @@
+package wallets
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jansemmelink/log"
+)
+
+//Currency is an ISO 4217 currency code, e.g. "ZAR"
+type Currency string
+
+const (
+	ZAR             Currency = "ZAR"
+	DefaultCurrency          = ZAR
+)
+
+//minorUnits is the number of decimals used by a currency
+//currencies not listed use 2
+var minorUnits = map[Currency]int{
+	"BWP": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"LSL": 2,
+	"NAD": 2,
+	"SZL": 2,
+	"USD": 2,
+	"ZAR": 2,
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z][A-Z][A-Z]$`)
+
+func ValidateCurrency(currency string) (Currency, error) {
+	c := strings.ToUpper(strings.Trim(currency, " "))
+	if !currencyPattern.MatchString(c) {
+		return "", log.Wrapf(nil, "invalid currency=\"%s\" must be ISO 4217 code", currency)
+	}
+	return Currency(c), nil
+}
+
+//MinorUnits is the number of decimals, e.g. 2 for cents
+func (c Currency) MinorUnits() int {
+	if n, ok := minorUnits[c]; ok {
+		return n
+	}
+	return 2
+}
+
+//Money is an amount in a currency, counted in minor units, e.g. cents
+//the zero value has no currency, use NewMoney
+type Money struct {
+	Currency Currency
+	Units    int64
+}
+
+func NewMoney(currency Currency, units int64) Money {
+	return Money{Currency: currency, Units: units}
+}
+
+//ParseMoney parses a decimal amount like "12.50" in the currency
+func ParseMoney(currency Currency, s string) (Money, error) {
+	s = strings.Trim(s, " ")
+	neg := strings.HasPrefix(s, "-")
+	if neg {
+		s = s[1:]
+	}
+	whole, fraction := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+	}
+	decimals := currency.MinorUnits()
+	if len(whole) == 0 || len(fraction) > decimals || strings.ContainsAny(whole+fraction, "+-") {
+		return Money{}, log.Wrapf(nil, "invalid %s amount \"%s\"", currency, s)
+	}
+	fraction += strings.Repeat("0", decimals-len(fraction))
+	units, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return Money{}, log.Wrapf(nil, "invalid %s amount \"%s\"", currency, s)
+	}
+	if neg {
+		units = -units
+	}
+	return NewMoney(currency, units), nil
+}
+
+//Decimal formats the amount without currency, e.g. "12.50"
+func (m Money) Decimal() string {
+	decimals := m.Currency.MinorUnits()
+	units := m.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	if decimals == 0 {
+		return fmt.Sprintf("%s%d", sign, units)
+	}
+	scale := int64(1)
+	for i := 0; i < decimals; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/scale, decimals, units%scale)
+}
+
+//String formats the amount with currency, e.g. "ZAR 12.50"
+func (m Money) String() string {
+	return string(m.Currency) + " " + m.Decimal()
+}
+
+func (m Money) IsPositive() bool { return m.Units > 0 }
+func (m Money) IsNegative() bool { return m.Units < 0 }
+func (m Money) IsZero() bool     { return m.Units == 0 }
+
+func (m Money) SameCurrency(o Money) bool {
+	return m.Currency == o.Currency
+}
+
+func (m Money) Neg() Money {
+	return NewMoney(m.Currency, -m.Units)
+}
+
+//Add returns m+o, mixing currencies is refused
+func (m Money) Add(o Money) (Money, error) {
+	if !m.SameCurrency(o) {
+		return Money{}, log.Wrapf(nil, "cannot add %s to %s", o.Currency, m.Currency)
+	}
+	return NewMoney(m.Currency, m.Units+o.Units), nil
+}
+
+//Sub returns m-o, mixing currencies is refused
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+//Convert returns m in another currency at rate units of the other
+//currency per unit of m's currency, e.g. ZAR 100.00 at 0.78 is BWP 78.00
+//fractions of the smallest unit are truncated, and a result too large
+//for int64 units is refused
+func (m Money) Convert(currency Currency, rate *big.Rat) (Money, error) {
+	r := new(big.Rat).SetInt64(m.Units)
+	r.Mul(r, rate)
+	r.Mul(r, new(big.Rat).SetFrac(pow10(currency.MinorUnits()), pow10(m.Currency.MinorUnits())))
+	units := new(big.Int).Quo(r.Num(), r.Denom())
+	if !units.IsInt64() {
+		return Money{}, log.Wrapf(nil, "%s at rate %s overflows %s", m, rate.RatString(), currency)
+	}
+	return NewMoney(currency, units.Int64()), nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+//MarshalJSON writes the decimal amount as a string, e.g. "12.50"
+//the currency is not included
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Decimal())
+}
+
+//UnmarshalJSON reads a decimal amount as string ("12.50") or number (12.5)
+//in the currency already set, or the default currency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), "\"")
+	c := m.Currency
+	if len(c) == 0 {
+		c = DefaultCurrency
+	}
+	parsed, err := ParseMoney(c, s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,154 @@
+package wallets
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		currency Currency
+		s        string
+		units    int64
+		ok       bool
+	}{
+		{ZAR, "12.50", 1250, true},
+		{ZAR, "12.5", 1250, true},
+		{ZAR, "12", 1200, true},
+		{ZAR, " 0.01 ", 1, true},
+		{ZAR, "-3.25", -325, true},
+		{ZAR, "92233720368547758.07", 9223372036854775807, true},
+		{"JPY", "500", 500, true},
+		{ZAR, "12.505", 0, false},
+		{"JPY", "1.5", 0, false},
+		{ZAR, "", 0, false},
+		{ZAR, ".50", 0, false},
+		{ZAR, "+1.00", 0, false},
+		{ZAR, "--1", 0, false},
+		{ZAR, "1.-5", 0, false},
+		{ZAR, "R10", 0, false},
+		{ZAR, "92233720368547758.08", 0, false},
+	}
+	for _, test := range tests {
+		m, err := ParseMoney(test.currency, test.s)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("ParseMoney(%s,%q) = %s, expected error", test.currency, test.s, m)
+			}
+			continue
+		}
+		if err != nil || m != NewMoney(test.currency, test.units) {
+			t.Errorf("ParseMoney(%s,%q) = %s,%v, expected %d units", test.currency, test.s, m, err, test.units)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m   Money
+		s   string
+		str string
+	}{
+		{NewMoney(ZAR, 1250), "12.50", "ZAR 12.50"},
+		{NewMoney(ZAR, 5), "0.05", "ZAR 0.05"},
+		{NewMoney(ZAR, 0), "0.00", "ZAR 0.00"},
+		{NewMoney(ZAR, -105), "-1.05", "ZAR -1.05"},
+		{NewMoney("JPY", 500), "500", "JPY 500"},
+		{NewMoney("XYZ", 123), "1.23", "XYZ 1.23"},
+	}
+	for _, test := range tests {
+		if s := test.m.Decimal(); s != test.s {
+			t.Errorf("%+v.Decimal() = %q, expected %q", test.m, s, test.s)
+		}
+		if s := test.m.String(); s != test.str {
+			t.Errorf("%+v.String() = %q, expected %q", test.m, s, test.str)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		m        Money
+		currency Currency
+		rate     string
+		units    int64
+		ok       bool
+	}{
+		{NewMoney(ZAR, 10000), "BWP", "0.78", 7800, true},
+		{NewMoney(ZAR, 10000), "JPY", "8.1", 810, true},
+		{NewMoney("JPY", 810), ZAR, "0.123456", 9999, true},
+		{NewMoney(ZAR, 1), "BWP", "0.5", 0, true},
+		{NewMoney(ZAR, 333), "USD", "1/3", 111, true},
+		{NewMoney(ZAR, 9223372036854775807), "BWP", "1", 9223372036854775807, true},
+		{NewMoney(ZAR, 9223372036854775807), "BWP", "1.01", 0, false},
+		{NewMoney(ZAR, 9223372036854775807), "JPY", "10000", 0, false},
+	}
+	for _, test := range tests {
+		rate, ok := new(big.Rat).SetString(test.rate)
+		if !ok {
+			t.Fatalf("invalid rate %s", test.rate)
+		}
+		c, err := test.m.Convert(test.currency, rate)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s at %s = %s, expected overflow", test.m, test.rate, c)
+			}
+			continue
+		}
+		if err != nil || c != NewMoney(test.currency, test.units) {
+			t.Errorf("%s at %s = %s,%v, expected %d units", test.m, test.rate, c, err, test.units)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		a, b Money
+		sum  Money
+		ok   bool
+	}{
+		{NewMoney(ZAR, 100), NewMoney(ZAR, 50), NewMoney(ZAR, 150), true},
+		{NewMoney(ZAR, 100), NewMoney(ZAR, -150), NewMoney(ZAR, -50), true},
+		{NewMoney(ZAR, 100), NewMoney("JPY", 50), Money{}, false},
+	}
+	for _, test := range tests {
+		sum, err := test.a.Add(test.b)
+		if (err == nil) != test.ok || sum != test.sum {
+			t.Errorf("%s + %s = %s,%v", test.a, test.b, sum, err)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	tests := []struct {
+		currency Currency
+		json     string
+		units    int64
+		ok       bool
+	}{
+		{"", `"12.50"`, 1250, true},
+		{"", `12.5`, 1250, true},
+		{"JPY", `"500"`, 500, true},
+		{"JPY", `"5.00"`, 0, false},
+		{"", `"abc"`, 0, false},
+	}
+	for _, test := range tests {
+		m := Money{Currency: test.currency}
+		err := json.Unmarshal([]byte(test.json), &m)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s in %s = %s, expected error", test.json, test.currency, m)
+			}
+			continue
+		}
+		if err != nil || m.Units != test.units {
+			t.Errorf("%s in %s = %s,%v, expected %d units", test.json, test.currency, m, err, test.units)
+			continue
+		}
+		j, err := json.Marshal(m)
+		if err != nil || string(j) != `"`+m.Decimal()+`"` {
+			t.Errorf("json(%s) = %s,%v", m, j, err)
+		}
+	}
+}
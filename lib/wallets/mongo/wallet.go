@@ -3,6 +3,7 @@ package mongo
 import (
 	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/jansemmelink/log"
@@ -14,6 +15,10 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func init() {
+	wallets.Register("mongo", Wallets)
+}
+
 //e.g. install("mongodb://localhost:27017")
 func Wallets(mongoURI string, dbName string, users users.IUsers) (wallets.IWallets, error) {
 	client, err := mongo.NewClient(options.Client().ApplyURI(mongoURI))
@@ -35,6 +40,19 @@ func Wallets(mongoURI string, dbName string, users users.IUsers) (wallets.IWalle
 	// }
 
 	collection := client.Database(dbName).Collection("wallets")
+	if _, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys: bson.D{{Key: "depRef", Value: 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"depRef": bson.M{"$type": "string"}}),
+		},
+	}); err != nil {
+		return nil, log.Wrapf(err, "Failed to create wallet indexes")
+	}
+
 	return &factory{
 		users:      users,
 		collection: collection,
@@ -46,126 +64,238 @@ type factory struct {
 	collection *mongo.Collection
 }
 
-func (f factory) New(u users.IUser, walletName string, minBalance wallets.Amount) (wallets.IWallet, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	id := uuid.NewV1().String()
-	res, err := f.collection.InsertOne(
-		ctx,
-		bson.M{
-			"id":         id,
-			"owner":      u.ID(),
-			"name":       walletName,
-			"minBalance": minBalance,
-		})
+func (f factory) New(u users.IUser, walletName string, minBalance wallets.Money) (wallets.IWallet, error) {
+	if len(walletName) < 1 {
+		return nil, log.Wrapf(nil, "missing wallet name")
+	}
+	currency, err := wallets.ValidateCurrency(string(minBalance.Currency))
 	if err != nil {
-		return nil, log.Wrapf(err, "failed to insert wallet into db")
+		return nil, log.Wrapf(err, "cannot create wallet with invalid currency")
+	}
+	if f.UserWallet(u.ID(), walletName) != nil {
+		return nil, log.Wrapf(nil, "user already has a wallet named %s", walletName)
 	}
 
-	log.Debugf("inserted %T: %+v", res, res)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
 	w := &mongoWallet{
-		id:         id,
+		collection: f.collection,
+		id:         uuid.NewV1().String(),
 		owner:      u,
 		name:       walletName,
-		minBalance: minBalance,
+		balance:    wallets.NewMoney(currency, 0),
+		minBalance: wallets.NewMoney(currency, minBalance.Units),
 	}
-	return w, nil
+
+	//the unique indexes refuse a duplicate name or deposit reference,
+	//retry with another deposit reference
+	for attempt := 0; attempt < 10; attempt++ {
+		w.depRef = newDepRef()
+		res, err := f.collection.InsertOne(
+			ctx,
+			bson.M{
+				"id":         w.id,
+				"owner":      u.ID(),
+				"name":       walletName,
+				"depRef":     w.depRef,
+				"currency":   currency,
+				"balance":    int64(0),
+				"minBalance": minBalance.Units,
+			})
+		if err == nil {
+			log.Debugf("inserted %T: %+v", res, res)
+			return w, nil
+		}
+		if !isDuplicateKey(err) {
+			return nil, log.Wrapf(err, "failed to insert wallet into db")
+		}
+		if f.UserWallet(u.ID(), walletName) != nil {
+			return nil, log.Wrapf(nil, "user already has a wallet named %s", walletName)
+		}
+	} //for each attempt
+	return nil, log.Wrapf(nil, "Unable to generate deposit reference")
 } //factory.New()
 
 func (f *factory) UserWallet(userID string, walletName string) wallets.IWallet {
 	if f == nil {
 		return nil
 	}
-	return nil
-} //factory.GetMsisdn()
+	return f.findOne(bson.M{"owner": userID, "name": walletName})
+} //factory.UserWallet()
 
 func (f factory) GetID(id string) wallets.IWallet {
+	return f.findOne(bson.M{"id": id})
+} //factory.GetID()
+
+//findOne returns the wallet matching the filter, or nil
+func (f factory) findOne(filter bson.M) wallets.IWallet {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	cur, err := f.collection.Find(ctx, bson.M{"id": id})
-	if err != nil {
-		log.Errorf("Failed to find id: %v", err)
+	var result bson.M
+	if err := f.collection.FindOne(ctx, filter).Decode(&result); err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Errorf("Failed to find wallet %v: %v", filter, err)
+		}
 		return nil
 	}
+	log.Debugf("GOT (%T): %+v", result, result)
+	if w := f.wallet(result); w != nil {
+		return w
+	}
+	return nil
+} //factory.findOne()
+
+func (f factory) All() map[string]wallets.IWallet {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	all := make(map[string]wallets.IWallet)
+	cur, err := f.collection.Find(ctx, bson.M{})
+	if err != nil {
+		log.Errorf("Failed to find wallets: %v", err)
+		return all
+	}
 	defer cur.Close(ctx)
 
 	for cur.Next(ctx) {
 		var result bson.M
-		err := cur.Decode(&result)
-		if err != nil {
+		if err := cur.Decode(&result); err != nil {
 			log.Errorf("Failed to get data: %v", err)
-			return nil
-		}
-		// do something with result....
-		log.Debugf("GOT (%T): %+v", result, result)
-
-		userID := result["owner"].(string)
-		user := f.users.GetID(userID)
-		if user == nil {
-			log.Errorf("Failed to get user from id=%s", result["owner"].(string))
-			return nil
+			continue
 		}
-
-		w := mongoWallet{
-			id:         result["id"].(string),
-			owner:      user,
-			name:       result["name"].(string),
-			minBalance: wallets.Amount(result["minBalance"].(int32)),
+		if w := f.wallet(result); w != nil {
+			all[w.id] = w
 		}
-		return &w
 	}
 	if err := cur.Err(); err != nil {
 		log.Errorf("Error: %v", err)
+	}
+	return all
+} //factory.All()
+
+//wallet makes a wallet from a stored document
+func (f factory) wallet(result bson.M) *mongoWallet {
+	userID, _ := result["owner"].(string)
+	user, err := f.users.GetID(userID)
+	if user == nil {
+		log.Errorf("Failed to get user from id=%s: %v", userID, err)
 		return nil
 	}
-	return nil
-} //factory.GetID()
+
+	currency := wallets.DefaultCurrency
+	if c, ok := result["currency"].(string); ok {
+		currency = wallets.Currency(c)
+	}
+	id, _ := result["id"].(string)
+	name, _ := result["name"].(string)
+	depRef, _ := result["depRef"].(string)
+	return &mongoWallet{
+		collection: f.collection,
+		id:         id,
+		owner:      user,
+		name:       name,
+		depRef:     depRef,
+		balance:    wallets.NewMoney(currency, units(result["balance"])),
+		minBalance: wallets.NewMoney(currency, units(result["minBalance"])),
+	}
+} //factory.wallet()
+
+//units converts a stored number of minor units
+//the driver decodes numbers as int32 or int64 depending on size
+func units(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+} //units()
 
 func (f *factory) GetByDepRef(ref string) wallets.IWallet {
-	return nil
+	if len(ref) == 0 {
+		return nil
+	}
+	return f.findOne(bson.M{"depRef": ref})
 } //factory.GetByDepRef()
 
+//isDuplicateKey is true when a unique index refused the write
+func isDuplicateKey(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+} //isDuplicateKey()
+
+//mongoWallet implements IWallet
+//the balance is only changed in the db, by the mongo journal in the same
+//db transaction as the journal entries, so other values of the same
+//wallet and other server instances see it
 type mongoWallet struct {
+	collection *mongo.Collection
 	id         string
 	owner      users.IUser
 	name       string
-	depRef     string
-	balance    wallets.Amount
-	minBalance wallets.Amount
+	minBalance wallets.Money
+
+	mutex   sync.Mutex
+	depRef  string
+	balance wallets.Money //last read from the db
 }
 
-func (w mongoWallet) ID() string {
+func (w *mongoWallet) ID() string {
 	return w.id
 }
 
-func (w mongoWallet) Owner() users.IUser {
+func (w *mongoWallet) Owner() users.IUser {
 	return w.owner
 }
 
-func (w mongoWallet) Name() string {
+func (w *mongoWallet) Name() string {
 	return w.name
 }
 
-func (w mongoWallet) Balance() wallets.Amount {
+func (w *mongoWallet) Currency() wallets.Currency {
+	return w.minBalance.Currency
+}
+
+//Balance reads the balance from the db
+//if that fails, it logs and returns the balance last read
+func (w *mongoWallet) Balance() wallets.Money {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result bson.M
+	err := w.collection.FindOne(ctx, bson.M{"id": w.id}, options.FindOne().SetProjection(bson.M{"balance": 1})).Decode(&result)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err != nil {
+		log.Errorf("Failed to get balance of wallet.id=%s: %v", w.id, err)
+		return w.balance
+	}
+	w.balance = wallets.NewMoney(w.balance.Currency, units(result["balance"]))
 	return w.balance
 }
 
-func (w mongoWallet) MinBalance() wallets.Amount {
+func (w *mongoWallet) MinBalance() wallets.Money {
 	return w.minBalance
 }
 
-func (w *mongoWallet) Debit(amount wallets.Amount) {
-	w.balance -= amount
-}
+//Debit does nothing, the mongo journal debits the wallet in the db
+func (w *mongoWallet) Debit(amount wallets.Money) {}
 
-func (w *mongoWallet) Credit(amount wallets.Amount) {
-	w.balance += amount
-}
+//Credit does nothing, the mongo journal credits the wallet in the db
+func (w *mongoWallet) Credit(amount wallets.Money) {}
 
 func (w *mongoWallet) DepositReference() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	return w.depRef
 }
 
@@ -175,21 +305,42 @@ func (w *mongoWallet) DepositReference() string {
 //to make it simple, the range is limited, and it should only be
 //used when user can make EFT payments into the wallet
 func (f *factory) NewDepRef(w wallets.IWallet) (string, error) {
-	// f.depRefMutex.Lock()
-	// defer f.depRefMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	//the unique index on depRef refuses a reference already in use
 	for attempt := 0; attempt < 10; attempt++ {
-		ref := "W-"
-		ref += string('0' + rand.Intn(10))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-		ref += "-"
-		ref += string('0' + rand.Intn(10))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-		ref += string('A' + rand.Intn(26))
-
-		return "", log.Wrapf(nil, "todo: dep ref not yet stored in db")
+		ref := newDepRef()
+		res, err := f.collection.UpdateOne(ctx, bson.M{"id": w.ID()}, bson.M{"$set": bson.M{"depRef": ref}})
+		if err != nil {
+			if isDuplicateKey(err) {
+				continue
+			}
+			return "", log.Wrapf(err, "failed to store deposit reference")
+		}
+		if res.MatchedCount == 0 {
+			return "", log.Wrapf(nil, "unknown wallet.id=%s", w.ID())
+		}
+		if mw, ok := w.(*mongoWallet); ok {
+			mw.mutex.Lock()
+			mw.depRef = ref
+			mw.mutex.Unlock()
+		}
+		return ref, nil
 	} //for each attempt
 	return "", log.Wrapf(nil, "Unable to generate deposit reference")
 } //factory.NewDepRef()
+
+func newDepRef() string {
+	ref := "W-"
+	ref += string(rune('0' + rand.Intn(10)))
+	ref += string(rune('A' + rand.Intn(26)))
+	ref += string(rune('A' + rand.Intn(26)))
+	ref += string(rune('A' + rand.Intn(26)))
+	ref += "-"
+	ref += string(rune('0' + rand.Intn(10)))
+	ref += string(rune('A' + rand.Intn(26)))
+	ref += string(rune('A' + rand.Intn(26)))
+	ref += string(rune('A' + rand.Intn(26)))
+	return ref
+} //newDepRef()
@@ -0,0 +1,26 @@
+package wallets
+
+import (
+	"github.com/jansemmelink/taxiching/lib/registry"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+//Backend opens wallets of the users in a store
+type Backend func(mongoURI string, dbName string, users users.IUsers) (IWallets, error)
+
+var backends = registry.New("wallets")
+
+//Register makes the wallets backend available by name, the ledger
+//needs a journal registered with the same name
+func Register(name string, b Backend) {
+	backends.Add(name, b)
+} //Register()
+
+//Open wallets with the named backend
+func Open(name string, mongoURI string, dbName string, users users.IUsers) (IWallets, error) {
+	b, err := backends.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return b.(Backend)(mongoURI, dbName, users)
+} //Open()
@@ -5,25 +5,30 @@ import (
 )
 
 type IWallets interface {
-	New(u users.IUser, name string, minBalance Amount) (IWallet, error)
+	//New creates a wallet in the currency of minBalance
+	New(u users.IUser, name string, minBalance Money) (IWallet, error)
 	NewDepRef(w IWallet) (string, error)
 	GetByDepRef(ref string) IWallet
+	GetID(id string) IWallet
 	UserWallet(userID string, walletName string) IWallet
-}
 
-type Amount int
+	//All returns all wallets by id
+	All() map[string]IWallet
+}
 
 type IWallet interface {
 	ID() string
 	Owner() users.IUser //=owner of the wallet, who may send from wallet
 	Name() string
-	Balance() Amount
-	MinBalance() Amount //default to 0, negative for account that may go negative
+	Currency() Currency
+	Balance() Money
+	MinBalance() Money //default to 0, negative for account that may go negative
 	DepositReference() string
 
 	//todo: need strict access to this, may be implement outside wallet e.g. in ledger
 	//and required logged in session to indicate who does it
 	//and apply access control to operations
-	Debit(amount Amount)
-	Credit(amount Amount)
+	//amount must be in the wallet currency
+	Debit(amount Money)
+	Credit(amount Money)
 }
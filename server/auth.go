@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/ledger"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+)
+
+type sessionContextKey struct{}
+
+type sessionHandler func(res http.ResponseWriter, req *http.Request, bank *ledger.Bank)
+
+//authenticated resolves the session before calling h, from the header
+//"Authorization: Bearer <session-id>", or from the {id} in the path of
+//the older /session/{id}/... routes
+//h gets the session from the request with requestSession()
+func authenticated(bank *ledger.Bank, h sessionHandler) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		token := bearerToken(req)
+		if len(token) == 0 {
+			token = req.URL.Query().Get(":id")
+		}
+		var s sessions.ISession
+		if len(token) > 0 {
+			s = bank.Sessions.GetID(token)
+		}
+		if s == nil {
+			res.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(res, "Unknown session", http.StatusUnauthorized)
+			return
+		}
+		h(res, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, s)), bank)
+	}
+} //authenticated()
+
+//fresh refuses a session that is too old for sensitive operations, so the
+//user must log in again, see sessions.Options.FreshFor
+func fresh(h sessionHandler) sessionHandler {
+	return func(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+		if !bank.Sessions.Options().Fresh(requestSession(req)) {
+			res.Header().Set("WWW-Authenticate", "Bearer error=\"insufficient_user_authentication\"")
+			http.Error(res, "Session too old for this operation, log in again", http.StatusUnauthorized)
+			return
+		}
+		h(res, req, bank)
+	}
+} //fresh()
+
+//requires refuses the request with 403 Forbidden when the session user
+//does not have the permission through one of their roles
+func requires(p users.Permission, h sessionHandler) sessionHandler {
+	return func(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+		if !users.Can(requestSession(req).User(), p) {
+			http.Error(res, "Permission "+string(p)+" required", http.StatusForbidden)
+			return
+		}
+		h(res, req, bank)
+	}
+} //requires()
+
+//logged logs the request with its route instead of the path, so the
+//session id in the path of the older /session/{id}/... routes is not
+//written to the log
+func logged(route string, h sessionHandler) sessionHandler {
+	return func(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+		log.Debugf("%s %s", req.Method, route)
+		h(res, req, bank)
+	}
+} //logged()
+
+//requestSession returns the session resolved by authenticated()
+func requestSession(req *http.Request) sessions.ISession {
+	s, _ := req.Context().Value(sessionContextKey{}).(sessions.ISession)
+	return s
+} //requestSession()
+
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+} //bearerToken()
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jansemmelink/log"
+	"github.com/jansemmelink/taxiching/lib/ledger"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/wallets"
+)
+
+//config of the server, read from a JSON file, e.g.
+//
+//	{
+//		"addr": "localhost:8080",
+//		"mongo": "mongodb://localhost:27017",
+//		"db": "taxiching",
+//		"admin": "27821234567",
+//		"bankMinBalance": "-100000.00",
+//		"fxMinBalances": {"ZAR": "-100000.00", "BWP": "-100000.00"},
+//		"session": {"idle": "5m", "max": "12h", "fresh": "15m"},
+//		"store": "mongo",
+//		"backends": {"sessions": "signed"}
+//	}
+//
+//each value can be overridden by an environment variable and a flag,
+//see settings
+//signed sessions need keys, best set with $TAXICHING_SESSION_KEYS to keep
+//the secrets out of the file
+type config struct {
+	Debug              bool          `json:"debug"`
+	Addr               string        `json:"addr"`
+	Mongo              string        `json:"mongo"`
+	DB                 string        `json:"db"`
+	Admin              string        `json:"admin"` //msisdn of the admin who owns the bank wallet
+	BankMinBalance     wallets.Money `json:"bankMinBalance"`
+	FXMinBalances      fxMinBalances `json:"fxMinBalances"` //FX wallets created by -setup
+	Session            sessionConfig `json:"session"`
+	DeprecatedGetLogin bool          `json:"deprecatedGetLogin"`
+	//TrustedProxies are IPs or CIDR networks of reverse proxies whose
+	//X-Forwarded-For header gives the client IP
+	TrustedProxies []string `json:"trustedProxies"`
+
+	//Store is the backend for users, wallets and goods, "mongo" or
+	//"memory", and Backends can choose another one for some of them
+	//sessions stay in memory unless Backends.Sessions is set
+	Store    string          `json:"store"`
+	Backends ledger.Backends `json:"backends"`
+}
+
+type sessionConfig struct {
+	Single       bool     `json:"single"`
+	Idle         duration `json:"idle"`
+	Max          duration `json:"max"`
+	ExtendOnRead bool     `json:"extendOnRead"`
+	Fresh        duration `json:"fresh"`
+	Reap         duration `json:"reap"`
+	//Keys sign the tokens of signed sessions, the first signs new tokens
+	Keys []sessionKey `json:"keys"`
+}
+
+type sessionKey struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"` //at least 32 characters
+}
+
+//parseSessionKeys parses "<id>:<secret>,<id>:<secret>"
+func parseSessionKeys(v string) ([]sessionKey, error) {
+	keys := []sessionKey{}
+	for _, k := range strings.Split(v, ",") {
+		if k = strings.TrimSpace(k); len(k) == 0 {
+			continue
+		}
+		i := strings.Index(k, ":")
+		if i <= 0 {
+			return nil, log.Wrapf(nil, "session key must be <id>:<secret>")
+		}
+		keys = append(keys, sessionKey{ID: k[:i], Secret: k[i+1:]})
+	}
+	return keys, nil
+} //parseSessionKeys()
+
+//fxMinBalances is written as {"<currency>": "<amount>"} in JSON
+type fxMinBalances []wallets.Money
+
+func (f *fxMinBalances) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return log.Wrapf(err, "FX min balances must be like {\"BWP\": \"-1000.00\"}")
+	}
+	list := fxMinBalances{}
+	for c, v := range m {
+		b, err := parseFXMinBalance(c, v)
+		if err != nil {
+			return err
+		}
+		list = append(list, b)
+	}
+	//sort for the same setup on every start
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	*f = list
+	return nil
+}
+
+//parseFXMinBalances parses "<currency>=<amount>,<currency>=<amount>"
+func parseFXMinBalances(v string) (fxMinBalances, error) {
+	list := fxMinBalances{}
+	for _, b := range strings.Split(v, ",") {
+		if b = strings.TrimSpace(b); len(b) == 0 {
+			continue
+		}
+		i := strings.Index(b, "=")
+		if i <= 0 {
+			return nil, log.Wrapf(nil, "FX min balance must be <currency>=<amount>")
+		}
+		m, err := parseFXMinBalance(b[:i], b[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, nil
+} //parseFXMinBalances()
+
+func parseFXMinBalance(currency, amount string) (wallets.Money, error) {
+	c, err := wallets.ValidateCurrency(currency)
+	if err != nil {
+		return wallets.Money{}, log.Wrapf(err, "invalid FX currency")
+	}
+	m, err := wallets.ParseMoney(c, amount)
+	if err != nil {
+		return wallets.Money{}, log.Wrapf(err, "invalid FX min balance for %s", c)
+	}
+	return m, nil
+} //parseFXMinBalance()
+
+//duration is written as "5m" in JSON
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return log.Wrapf(err, "duration must be a string like \"5m\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return log.Wrapf(err, "invalid duration \"%s\"", s)
+	}
+	*d = duration(v)
+	return nil
+}
+
+func defaultConfig() config {
+	b := ledger.DefaultConfig()
+	return config{
+		Addr:           "localhost:8080",
+		Mongo:          b.MongoURI,
+		DB:             b.DBName,
+		BankMinBalance: b.BankMinBalance,
+		Session: sessionConfig{
+			Single:       b.Sessions.SingleSession,
+			Idle:         duration(b.Sessions.IdleTimeout),
+			Max:          duration(b.Sessions.MaxLifetime),
+			ExtendOnRead: b.Sessions.ExtendOnRead,
+			Fresh:        duration(b.Sessions.FreshFor),
+			Reap:         duration(time.Minute),
+		},
+	}
+} //defaultConfig()
+
+//setting is a config value that can be set with a flag and an
+//environment variable
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	isBool bool
+	set    func(c *config, v string) error
+}
+
+var settings = []setting{
+	{"debug", "TAXICHING_DEBUG", "DEBUG Mode", true, func(c *config, v string) (err error) { c.Debug, err = strconv.ParseBool(v); return }},
+	{"addr", "TAXICHING_ADDR", "HTTP Server address", false, func(c *config, v string) error { c.Addr = v; return nil }},
+	{"mongo", "TAXICHING_MONGO", "Mongo address", false, func(c *config, v string) error { c.Mongo = v; return nil }},
+	{"db", "TAXICHING_DB", "Mongo database name", false, func(c *config, v string) error { c.DB = v; return nil }},
+	{"admin", "TAXICHING_ADMIN", "MSISDN of the admin user who owns the bank wallet", false, func(c *config, v string) error { c.Admin = v; return nil }},
+	{"bank-min-balance", "TAXICHING_BANK_MIN_BALANCE", "Lowest balance of the bank wallet, e.g. -100000.00", false, func(c *config, v string) (err error) {
+		c.BankMinBalance, err = wallets.ParseMoney(wallets.DefaultCurrency, v)
+		return
+	}},
+	{"fx-min-balances", "TAXICHING_FX_MIN_BALANCES", "Lowest balance of the bank FX wallet per currency, e.g. ZAR=-100000.00,BWP=-100000.00, created by -setup", false, func(c *config, v string) (err error) {
+		c.FXMinBalances, err = parseFXMinBalances(v)
+		return
+	}},
+	{"single-session", "TAXICHING_SESSION_SINGLE", "End other sessions of a user when they log in", true, func(c *config, v string) (err error) { c.Session.Single, err = strconv.ParseBool(v); return }},
+	{"session-idle", "TAXICHING_SESSION_IDLE", "Session expires after this time without use", false, func(c *config, v string) error { return setDuration(&c.Session.Idle, v) }},
+	{"session-max", "TAXICHING_SESSION_MAX", "Session expires this long after login, 0 for no limit", false, func(c *config, v string) error { return setDuration(&c.Session.Max, v) }},
+	{"session-extend-on-read", "TAXICHING_SESSION_EXTEND_ON_READ", "Extend the session on every request, else only on keepalive", true, func(c *config, v string) (err error) {
+		c.Session.ExtendOnRead, err = strconv.ParseBool(v)
+		return
+	}},
+	{"session-reap", "TAXICHING_SESSION_REAP", "Interval to remove expired sessions", false, func(c *config, v string) error { return setDuration(&c.Session.Reap, v) }},
+	{"session-fresh", "TAXICHING_SESSION_FRESH", "Sending money needs a session younger than this, 0 for no limit", false, func(c *config, v string) error { return setDuration(&c.Session.Fresh, v) }},
+	{"session-keys", "TAXICHING_SESSION_KEYS", "Keys of signed sessions as <id>:<secret>,... the first signs new tokens", false, func(c *config, v string) (err error) {
+		c.Session.Keys, err = parseSessionKeys(v)
+		return
+	}},
+	{"store", "TAXICHING_STORE", "Backend for users, wallets and goods: mongo, or memory to run in-process, sessions are set in backends", false, func(c *config, v string) error { c.Store = v; return nil }},
+	{"deprecated-get-login", "TAXICHING_DEPRECATED_GET_LOGIN", "Allow deprecated GET /user/{id}/login/{pin}", true, func(c *config, v string) (err error) {
+		c.DeprecatedGetLogin, err = strconv.ParseBool(v)
+		return
+	}},
+	{"trusted-proxies", "TAXICHING_TRUSTED_PROXIES", "Comma separated IPs or CIDR networks of proxies trusted to set X-Forwarded-For", false, func(c *config, v string) error {
+		c.TrustedProxies = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); len(p) > 0 {
+				c.TrustedProxies = append(c.TrustedProxies, p)
+			}
+		}
+		return nil
+	}},
+}
+
+func setDuration(d *duration, v string) error {
+	t, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = duration(t)
+	return nil
+} //setDuration()
+
+//flagValue keeps the flag value until the config is loaded, so that
+//flags override the file and environment
+type flagValue struct {
+	s     setting
+	value *string
+}
+
+func (f flagValue) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f flagValue) Set(v string) error {
+	*f.value = v
+	return nil
+}
+
+func (f flagValue) IsBoolFlag() bool {
+	return f.s.isBool
+}
+
+//configFlags registers the settings as flags on fs, call load() after
+//fs is parsed
+func configFlags(fs *flag.FlagSet) *configLoader {
+	l := &configLoader{
+		fs:    fs,
+		file:  fs.String("config", os.Getenv("TAXICHING_CONFIG"), "JSON config file, settings can be overridden with environment variables and flags"),
+		flags: make(map[string]*string),
+	}
+	for _, s := range settings {
+		v := new(string)
+		l.flags[s.flag] = v
+		fs.Var(flagValue{s: s, value: v}, s.flag, s.usage+" ($"+s.env+")")
+	}
+	return l
+} //configFlags()
+
+type configLoader struct {
+	fs    *flag.FlagSet
+	file  *string
+	flags map[string]*string
+}
+
+//load the config from defaults, the file, the environment and the flags,
+//each overriding the one before, then validate it
+func (l *configLoader) load() (config, error) {
+	c := defaultConfig()
+	if len(*l.file) > 0 {
+		f, err := os.Open(*l.file)
+		if err != nil {
+			return c, log.Wrapf(err, "cannot open config file")
+		}
+		defer f.Close()
+		d := json.NewDecoder(f)
+		d.DisallowUnknownFields()
+		if err := d.Decode(&c); err != nil {
+			return c, log.Wrapf(err, "invalid config file %s", *l.file)
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			if err := s.set(&c, v); err != nil {
+				return c, log.Wrapf(err, "invalid $%s=\"%s\"", s.env, v)
+			}
+		}
+	}
+	var err error
+	l.fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(&c, *l.flags[s.flag]); e != nil {
+					err = log.Wrapf(e, "invalid -%s=\"%s\"", s.flag, *l.flags[s.flag])
+				}
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	return c, c.validate()
+} //configLoader.load()
+
+func (c config) validate() error {
+	if len(c.Addr) == 0 {
+		return log.Wrapf(nil, "missing HTTP server address")
+	}
+	if c.Session.Reap <= 0 {
+		return log.Wrapf(nil, "session reap interval must be positive")
+	}
+	if _, err := parseProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.bank().Backends.Sessions == "signed" && len(c.Session.Keys) == 0 {
+		return log.Wrapf(nil, "signed sessions need keys, set $TAXICHING_SESSION_KEYS")
+	}
+	if _, err := c.bank().Validate(); err != nil {
+		return err
+	}
+	return nil
+} //config.validate()
+
+//bank returns the part of the config used by the ledger
+func (c config) bank() ledger.Config {
+	b := ledger.DefaultConfig()
+	b.MongoURI = c.Mongo
+	b.DBName = c.DB
+	b.AdminMsisdn = c.Admin
+	b.BankMinBalance = c.BankMinBalance
+	b.FXMinBalances = c.FXMinBalances
+	b.Sessions.SingleSession = c.Session.Single
+	b.Sessions.IdleTimeout = time.Duration(c.Session.Idle)
+	b.Sessions.MaxLifetime = time.Duration(c.Session.Max)
+	b.Sessions.ExtendOnRead = c.Session.ExtendOnRead
+	b.Sessions.FreshFor = time.Duration(c.Session.Fresh)
+	for _, k := range c.Session.Keys {
+		b.Sessions.Keys = append(b.Sessions.Keys, sessions.Key{ID: k.ID, Secret: []byte(k.Secret)})
+	}
+	if len(c.Store) > 0 {
+		s := b.Backends.Sessions
+		b.Backends = ledger.AllBackends(c.Store)
+		b.Backends.Sessions = s
+	}
+	if len(c.Backends.Users) > 0 {
+		b.Backends.Users = c.Backends.Users
+	}
+	if len(c.Backends.Wallets) > 0 {
+		b.Backends.Wallets = c.Backends.Wallets
+	}
+	if len(c.Backends.Goods) > 0 {
+		b.Backends.Goods = c.Backends.Goods
+	}
+	if len(c.Backends.Sessions) > 0 {
+		b.Backends.Sessions = c.Backends.Sessions
+	}
+	return b
+} //config.bank()
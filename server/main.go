@@ -1,57 +1,167 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/jansemmelink/log"
 
 	"github.com/jansemmelink/taxiching/lib/ledger"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+
+	//backends selected by name in the config
+	_ "github.com/jansemmelink/taxiching/lib/goods/memory"
+	_ "github.com/jansemmelink/taxiching/lib/goods/mongo"
+	_ "github.com/jansemmelink/taxiching/lib/sessions/memory"
+	_ "github.com/jansemmelink/taxiching/lib/sessions/mongo"
+	_ "github.com/jansemmelink/taxiching/lib/sessions/signed"
+	_ "github.com/jansemmelink/taxiching/lib/users/memory"
+	_ "github.com/jansemmelink/taxiching/lib/users/mongo"
+	_ "github.com/jansemmelink/taxiching/lib/wallets/memory"
+	_ "github.com/jansemmelink/taxiching/lib/wallets/mongo"
 )
 
-const timeFormat = "2006-01-02T15:04:05+07:00"
+const timeFormat = time.RFC3339
+
+//adminPinEnv is the environment variable with the pin for -setup
+const adminPinEnv = "TAXICHING_ADMIN_PIN"
 
 func main() {
-	debugFlag := flag.Bool("debug", false, "DEBUG Mode")
-	addrFlag := flag.String("addr", "localhost:8080", "HTTP Server address")
-	mongoURIFlag := flag.String("mongo", "mongodb://localhost:27017", "Mongo address")
+	loader := configFlags(flag.CommandLine)
+	setupFlag := flag.Bool("setup", false, "Create the admin user and bank wallet, then exit (pin from $"+adminPinEnv+")")
+	adminNameFlag := flag.String("admin-name", "admin", "Name of the admin user created by -setup")
 	flag.Parse()
-	if *debugFlag {
+	c, err := loader.load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config: %v\n", err)
+		os.Exit(1)
+	}
+	if c.Debug {
 		log.DebugOn()
 		log.Debugf("DEBUG Mode")
 	}
+	deprecatedGetLogin = c.DeprecatedGetLogin
+	trustedProxies, _ = parseProxies(c.TrustedProxies) //checked by load()
 
-	bank := ledger.New(*mongoURIFlag)
+	//users in memory start empty, so setup is done on every start
+	//the pin comes from the environment to keep it out of the shell history
+	inMemory := c.bank().Backends.Users == "memory"
+	adminPin := os.Getenv(adminPinEnv)
+	if (*setupFlag || inMemory) && len(adminPin) == 0 {
+		fmt.Fprintf(os.Stderr, "Setup needs the admin pin in $%s\n", adminPinEnv)
+		os.Exit(1)
+	}
 
-	fmt.Fprintf(os.Stdout, "Serving %s\n", *addrFlag)
-	if err := http.ListenAndServe(*addrFlag, router(bank)); err != nil {
+	bank := ledger.New(c.bank())
+	if *setupFlag || inMemory {
+		if err := bank.Setup(c.Admin, *adminNameFlag, adminPin, c.BankMinBalance, c.FXMinBalances); err != nil {
+			fmt.Fprintf(os.Stderr, "Setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Setup done for admin msisdn=%s\n", c.Admin)
+		if !inMemory {
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bank.Sessions.StartReaper(ctx, time.Duration(c.Session.Reap))
+	auditSessions(bank.Sessions)
+
+	fmt.Fprintf(os.Stdout, "Serving %s\n", c.Addr)
+	if err := http.ListenAndServe(c.Addr, router(bank)); err != nil {
 		panic(log.Wrapf(err, "HTTP Server failed"))
 	}
 }
 
+//audit writes an event for the audit trail to stdout
+func audit(event string, format string, args ...interface{}) {
+	fmt.Fprintf(os.Stdout, "%s %s %s\n", time.Now().Format(timeFormat), event, fmt.Sprintf(format, args...))
+} //audit()
+
+//auditSessions writes logins, logouts and lockouts to stdout
+func auditSessions(s sessions.ISessions) {
+	on := func(event string) func(sessions.ISession) {
+		return func(s sessions.ISession) {
+			c := s.Client()
+			audit(event, "user.id=%s ip=%s device=%q", s.User().ID(), c.IP, c.Device)
+		}
+	}
+	s.OnStart(on("LOGIN"))
+	s.OnEnd(on("LOGOUT"))
+	s.OnExpire(on("EXPIRED"))
+	s.OnAudit(audit)
+} //auditSessions()
+
 func router(bank *ledger.Bank) http.Handler {
 	r := pat.New()
 	r.Get("/user/msisdn/{msisdn}", func(res http.ResponseWriter, req *http.Request) { UserGetMsisdn(res, req, bank) })
-	r.Get("/user/{id}/login/{pin}", func(res http.ResponseWriter, req *http.Request) { UserLogin(res, req, bank) })
+	r.Post("/login", func(res http.ResponseWriter, req *http.Request) { Login(res, req, bank) })
+	if deprecatedGetLogin {
+		r.Get("/user/{id}/login/{pin}", func(res http.ResponseWriter, req *http.Request) { UserLogin(res, req, bank) })
+	} else {
+		//registered so the pin is not logged by the /user/{id} route
+		r.Get("/user/{id}/login/", func(res http.ResponseWriter, req *http.Request) {
+			http.Error(res, "Login with POST /login", http.StatusGone)
+		})
+	}
 	r.Get("/user/{id}", func(res http.ResponseWriter, req *http.Request) { UserGetID(res, req, bank) })
 	r.Post("/user", func(res http.ResponseWriter, req *http.Request) { UserAdd(res, req, bank) })
 
-	//session: goods
-	r.Post("/session/{id}/pay/goods/{goodsid}", func(res http.ResponseWriter, req *http.Request) { SessionPayGoods(res, req, bank) })
-	r.Delete("/session/{id}/goods/{goodsid}", func(res http.ResponseWriter, req *http.Request) { SessionGoodsDel(res, req, bank) })
-	r.Get("/session/{id}/goods", func(res http.ResponseWriter, req *http.Request) { SessionGoodsList(res, req, bank) })
-	r.Post("/session/{id}/goods", func(res http.ResponseWriter, req *http.Request) { SessionGoodsAdd(res, req, bank) })
+	//session routes take the session from "Authorization: Bearer <session-id>"
+	//and are also served as /session/{id}/... for older clients
+	//the bearer routes are registered first, because pat matches by prefix
+	//fresh() routes move money and need a recent login
+	//requires() routes need a permission from the user's roles
+	sessionRoutes := []struct {
+		method  string
+		path    string
+		handler sessionHandler
+	}{
+		//goods
+		{http.MethodPost, "/pay/goods/{goodsid}", fresh(requires(users.PermSend, SessionPayGoods))},
+		{http.MethodDelete, "/goods/{goodsid}", requires(users.PermSellGoods, SessionGoodsDel)},
+		{http.MethodGet, "/goods", SessionGoodsList},
+		{http.MethodPost, "/goods", requires(users.PermSellGoods, SessionGoodsAdd)},
+
+		//reverse/refund a payment received
+		{http.MethodPost, "/reverse/{txid}", fresh(SessionReverse)},
+
+		{http.MethodGet, "/keepalive", SessionKeepAlive},
+		{http.MethodGet, "/ministatement", SessionMiniStatement},
+		{http.MethodGet, "/statement", SessionStatement},
+
+		{http.MethodGet, "/logout", SessionLogout},
 
-	r.Get("/session/{id}/keepalive", func(res http.ResponseWriter, req *http.Request) { SessionKeepAlive(res, req, bank) })
-	r.Get("/session/{id}/ministatement", func(res http.ResponseWriter, req *http.Request) { SessionMiniStatement(res, req, bank) })
+		//devices the user is logged in on, {ref} register before the list
+		{http.MethodGet, "/devices", SessionDevices},
+		{http.MethodDelete, "/devices/{ref}", SessionDeviceEnd},
+		{http.MethodDelete, "/devices", SessionDevicesEnd},
 
-	r.Get("/session/{id}/logout", func(res http.ResponseWriter, req *http.Request) { SessionLogout(res, req, bank) })
+		//between own wallets in different currencies at a supplied rate
+		{http.MethodPost, "/convert", fresh(requires(users.PermConvert, SessionConvert))},
 
-	//for demo:
-	//EFT:
-	r.Post("/session/{id}/deposit", func(res http.ResponseWriter, req *http.Request) { SessionDeposit(res, req, bank) })
+		//for demo:
+		//EFT:
+		{http.MethodPost, "/deposit", fresh(requires(users.PermDeposit, SessionDeposit))},
+
+		//admin: unlock user after failed logins, roles, ledger integrity check
+		{http.MethodPost, "/admin/unlock/{userid}", requires(users.PermUnlockUser, SessionUnlockUser)},
+		{http.MethodPost, "/admin/roles/{userid}", requires(users.PermManageRoles, SessionSetRoles)},
+		{http.MethodGet, "/admin/verify", requires(users.PermVerify, SessionVerify)},
+	}
+	for _, sr := range sessionRoutes {
+		r.Add(sr.method, "/session"+sr.path, authenticated(bank, logged("/session"+sr.path, sr.handler)))
+	}
+	for _, sr := range sessionRoutes {
+		r.Add(sr.method, "/session/{id}"+sr.path, authenticated(bank, logged("/session/{id}"+sr.path, sr.handler)))
+	}
 	return r
 }
@@ -1,51 +1,62 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/ledger"
 	"github.com/jansemmelink/taxiching/lib/sessions"
-	_ "github.com/jansemmelink/taxiching/lib/sessions/memory"
 	"github.com/jansemmelink/taxiching/lib/users"
-	_ "github.com/jansemmelink/taxiching/lib/users/memory"
 	"github.com/jansemmelink/taxiching/lib/wallets"
-	_ "github.com/jansemmelink/taxiching/lib/wallets/memory"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func TestThings(t *testing.T) {
-	log.DebugOn()
+//newBank makes a bank with all backends in memory
+func newBank(t *testing.T) *ledger.Bank {
+	config := ledger.DefaultConfig()
+	config.AdminMsisdn = "27824526299"
+	config.Backends = ledger.AllBackends("memory")
+	bank := ledger.New(config)
 
-	//create wallet to represent bank account for EFT deposits
-	adminUser, err := users.New("27824526299", "admin", "admin")
-	if err != nil {
-		panic(log.Wrapf(err, "Failed to create admin user"))
-	}
-	bankWallet, err := wallets.New(adminUser.ID(), "bank", -100000000)
-	if err != nil {
-		panic(log.Wrapf(err, "Failed to create bank wallet"))
+	//admin user with the bank wallet for EFT deposits
+	if err := bank.Setup(config.AdminMsisdn, "admin", "admin", wallets.NewMoney(wallets.DefaultCurrency, -100000000), config.FXMinBalances); err != nil {
+		t.Fatalf("Failed to setup bank: %v", err)
 	}
+	return bank
+}
+
+func TestThings(t *testing.T) {
+	log.DebugOn()
+	users.PasswordCost = bcrypt.MinCost
+	bank := newBank(t)
+	adminUser := bank.BankWallet.Owner()
 
 	//create wallet for all unknown deposits
-	unknownUserWallet, err := wallets.New(adminUser.ID(), "unknown-user", 0)
+	unknownUserWallet, err := bank.Wallets.New(adminUser, "unknown-user", wallets.NewMoney(wallets.DefaultCurrency, 0))
 	if err != nil {
 		t.Fatalf("Failed to create unknown user wallet for id=%s: %v", adminUser.ID(), err)
 	}
 
-	adminSession, err := sessions.New(adminUser.ID(), "admin")
+	adminSession, err := bank.Sessions.New(adminUser.ID(), "admin", sessions.Client{})
 	if err != nil {
-		panic(log.Wrapf(err, "failed to create admin session"))
+		t.Fatalf("failed to create admin session: %v", err)
 	}
 
-	user1, wallet1 := newUser("27111111111", "one", "aa11")
-	_ /*user2*/, wallet2 := newUser("27222222222", "two", "bb22")
+	user1, wallet1 := newUser(t, bank, "27111111111", "one", "aa11")
+	_ /*user2*/, wallet2 := newUser(t, bank, "27222222222", "two", "bb22")
 
 	//EFT deposits into our bank account with that wallet's deposit reference
 	//are loaded from the bank statement into the user wallet
 	//this is sent from admin account, so needs admin session to do this
 	deposits := []struct {
 		ref    string
-		amount wallets.Amount
+		amount int64
 	}{
 		{wallet2.DepositReference(), 10000},
 		{"Joe Smith", 50000},
@@ -53,47 +64,50 @@ func TestThings(t *testing.T) {
 		{"W-3AAA-5BBB", 6000},
 	}
 	for _, dep := range deposits {
-		depWallet := wallets.GetByDepRef(dep.ref)
+		depWallet := bank.Wallets.GetByDepRef(dep.ref)
 		if depWallet == nil {
 			depWallet = unknownUserWallet
 		}
-		if _, err := ledger.Send(
+		if _, err := bank.Send(
 			adminSession,
-			bankWallet,
+			bank.BankWallet,
 			depWallet,
-			dep.amount,
-			"EFT deposit"); err != nil {
-			panic(log.Wrapf(err, "Failed to load deposit"))
+			wallets.NewMoney(wallets.DefaultCurrency, dep.amount),
+			"EFT deposit",
+			""); err != nil {
+			t.Fatalf("Failed to load deposit: %v", err)
 		}
 	} //for each deposit
 
-	sessionUser1, err := sessions.New(user1.ID(), "aa11")
+	sessionUser1, err := bank.Sessions.New(user1.ID(), "aa11", sessions.Client{})
 	if err != nil {
-		panic(log.Wrapf(err, "failed to login as one"))
+		t.Fatalf("failed to login as one: %v", err)
 	}
 
 	//user can transfer from own wallet to other user's wallet's deposit reference
-	if _, err := ledger.Send(
+	if _, err := bank.Send(
 		sessionUser1,
 		wallet1,
 		wallet2,
-		50,
-		"xyz"); err != nil {
-		panic("Failed to send money")
+		wallets.NewMoney(wallets.DefaultCurrency, 50),
+		"xyz",
+		""); err != nil {
+		t.Fatalf("Failed to send money: %v", err)
 	}
 
-	//products are created per user
-
-	//show status
-	log.Debugf("Wallets:")
-	for _, w := range wallets.All() {
-		log.Debugf("%s %s %s %d", w.ID(), w.Owner().Name(), w.Name(), w.Balance())
+	if wallet1.Balance().Units != 12000-50 || wallet2.Balance().Units != 10000+50 || unknownUserWallet.Balance().Units != 56000 {
+		t.Fatalf("wrong balances %s %s %s", wallet1.Balance(), wallet2.Balance(), unknownUserWallet.Balance())
+	}
+	report, err := bank.Verify()
+	if err != nil || !report.OK() {
+		t.Fatalf("ledger does not verify: %+v %v", report, err)
 	}
 
 	//show transactions
 	log.Debugf("Transactions:")
-	for _, t := range ledger.All() {
-		log.Debugf("%s %s %s %d %s %s", t.Timestamp(),
+	all, _ := bank.Transactions.All()
+	for _, t := range all {
+		log.Debugf("%s %s %s %s %s %s", t.Timestamp(),
 			t.DebitWallet().Name(),
 			t.CreditWallet().Name(),
 			t.Amount(),
@@ -102,30 +116,320 @@ func TestThings(t *testing.T) {
 	}
 }
 
-func newUser(m, n, p string) (users.IUser, wallets.IWallet) {
-	//normal user session to register user and create new user-wallet
-	//s := sessions.New()
-	//log.Debugf("s:{id:%s}", s.ID())
-
-	u, err := users.New(m, n, p)
+func newUser(t *testing.T, bank *ledger.Bank, m, n, p string) (users.IUser, wallets.IWallet) {
+	u, err := bank.Users.New(m, n, p)
 	if err != nil {
-		panic(log.Wrapf(err, "failed to create user(%s)", n))
+		t.Fatalf("failed to create user(%s): %v", n, err)
 	}
-	w, err := wallets.New(u.ID(), "default", 0)
+	w, err := bank.Wallets.New(u, "default", wallets.NewMoney(wallets.DefaultCurrency, 0))
 	if err != nil {
-		panic(log.Wrapf(err, "failed to create user default wallet"))
+		t.Fatalf("failed to create user default wallet: %v", err)
 	}
-
-	// if user1.Auth("aaa") {
-	// 	panic("User auth success on wrong password")
-	// }
-	// if !user1.Auth("defg") {
-	// 	panic("User auth fail on correct password")
-	// }
-	// s.Set("user", user1.ID())
-	// s.Set("wallet", w.ID())
-
 	log.Debugf("user:{id:%s,name:%s}", u.ID(), u.Name())
 	log.Debugf("wallet:{id:%s,user:%s}", w.ID(), w.Owner().ID())
 	return u, w
 }
+
+//TestConcurrentRequests drives many concurrent pay and keepalive requests
+//through the router, run with go test -race
+func TestConcurrentRequests(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	bank := newBank(t)
+	handler := router(bank)
+
+	do := func(method, path, token, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code, res.Body.String()
+	}
+	login := func(msisdn, pin string) string {
+		code, body := do(http.MethodPost, "/login", "", fmt.Sprintf(`{"msisdn":"%s","pin":"%s"}`, msisdn, pin))
+		var s sessionData
+		if code != http.StatusOK || json.Unmarshal([]byte(body), &s) != nil {
+			t.Fatalf("login %s failed: %d %s", msisdn, code, body)
+		}
+		return s.SID
+	}
+
+	//driver with goods, passengers may not sell
+	admin := login("27824526299", "admin")
+	driver, _ := newUser(t, bank, "27800000000", "seller", "0000")
+	seller := login("27800000000", "0000")
+	if code, _ := do(http.MethodPost, "/session/goods", seller, `{"Name":"ride","Cost":"1.00"}`); code != http.StatusForbidden {
+		t.Fatalf("passenger added goods: %d", code)
+	}
+	if code, body := do(http.MethodPost, "/session/admin/roles/"+driver.ID(), seller, `{"roles":["admin"]}`); code != http.StatusForbidden {
+		t.Fatalf("passenger changed roles: %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/session/admin/roles/"+driver.ID(), admin, `{"roles":["driver"]}`); code != http.StatusOK {
+		t.Fatalf("failed to set roles: %d %s", code, body)
+	}
+	code, body := do(http.MethodPost, "/session/goods", seller, `{"Name":"ride","Cost":"1.00"}`)
+	var ride goodsData
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &ride) != nil {
+		t.Fatalf("failed to add goods: %d %s", code, body)
+	}
+
+	//passengers with money
+	const passengers = 10
+	const rides = 20
+	tokens := make([]string, passengers)
+	for i := range tokens {
+		msisdn := fmt.Sprintf("278100000%02d", i)
+		newUser(t, bank, msisdn, fmt.Sprintf("passenger%d", i), "1234")
+		if code, body := do(http.MethodPost, "/session/deposit", admin, fmt.Sprintf(`{"msisdn":"%s","amount":"%d.00"}`, msisdn, rides)); code != http.StatusOK {
+			t.Fatalf("failed to deposit: %d %s", code, body)
+		}
+		tokens[i] = login(msisdn, "1234")
+	}
+
+	//each passenger pays for all rides while keeping the session alive
+	//and the seller checks the statement
+	wg := sync.WaitGroup{}
+	errs := make(chan string, passengers*rides*2)
+	for _, token := range tokens {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			for i := 0; i < rides; i++ {
+				if code, body := do(http.MethodPost, "/session/pay/goods/"+ride.ID, token, ""); code != http.StatusOK {
+					errs <- fmt.Sprintf("pay: %d %s", code, body)
+				}
+				if code, body := do(http.MethodGet, "/session/keepalive", token, ""); code != http.StatusOK {
+					errs <- fmt.Sprintf("keepalive: %d %s", code, body)
+				}
+			}
+		}(token)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rides; i++ {
+			if code, body := do(http.MethodGet, "/session/ministatement", seller, ""); code != http.StatusOK {
+				errs <- fmt.Sprintf("ministatement: %d %s", code, body)
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+
+	sellerWallet := bank.Wallets.UserWallet(driver.ID(), "default")
+	if sellerWallet.Balance().Units != passengers*rides*100 {
+		t.Fatalf("seller balance %s, expected %d rides", sellerWallet.Balance(), passengers*rides)
+	}
+	report, err := bank.Verify()
+	if err != nil || !report.OK() {
+		t.Fatalf("ledger does not verify: %+v %v", report, err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	var err error
+	if trustedProxies, err = parseProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatalf("failed to parse proxies: %v", err)
+	}
+	defer func() { trustedProxies = nil }()
+	tests := []struct {
+		remote    string
+		forwarded string
+		ip        string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"10.1.1.1:1234", "5.6.7.8", "5.6.7.8"},
+		{"10.1.1.1:1234", "9.9.9.9, 5.6.7.8", "5.6.7.8"},
+		{"10.1.1.1:1234", "5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.1.1.1:1234", "", "10.1.1.1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		req.RemoteAddr = test.remote
+		if len(test.forwarded) > 0 {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := clientIP(req); ip != test.ip {
+			t.Errorf("%s forwarded for %q: got %s, expected %s", test.remote, test.forwarded, ip, test.ip)
+		}
+	}
+}
+
+//TestLockoutShared fails logins on one server instance and checks that
+//another instance with the same users store delays the next login
+func TestLockoutShared(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	bank := newBank(t)
+	u, _ := newUser(t, bank, "27830000000", "locked", "1234")
+	other, err := sessions.Open("memory", "", "", bank.Users, bank.Sessions.Options())
+	if err != nil {
+		t.Fatalf("failed to open sessions: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := bank.Sessions.New(u.ID(), "0000", sessions.Client{IP: fmt.Sprintf("1.1.1.%d", i)}); err == nil {
+			t.Fatalf("login with wrong pin")
+		}
+	}
+	if _, err := other.New(u.ID(), "1234", sessions.Client{IP: "2.2.2.2"}); err == nil {
+		t.Fatalf("delayed user logged in on other instance")
+	} else if _, ok := err.(*sessions.LoginError); !ok {
+		t.Fatalf("expected login error, got %v", err)
+	}
+	if !other.Unlock(u.ID(), "test") {
+		t.Fatalf("unlock on other instance failed")
+	}
+	if _, err := bank.Sessions.New(u.ID(), "1234", sessions.Client{IP: "2.2.2.2"}); err != nil {
+		t.Fatalf("failed to login after unlock: %v", err)
+	}
+}
+
+//TestLedgerErrors checks the status of requests the ledger refuses
+func TestLedgerErrors(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	bank := newBank(t)
+	handler := router(bank)
+
+	do := func(method, path, token, key, body string) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if len(key) > 0 {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code, res.Body.String()
+	}
+	admin, err := bank.Sessions.New(bank.BankWallet.Owner().ID(), "admin", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to create admin session: %v", err)
+	}
+	driver, _ := newUser(t, bank, "27800000000", "driver", "0000")
+	if err := driver.SetRoles(users.RoleDriver); err != nil {
+		t.Fatalf("failed to set roles: %v", err)
+	}
+	g, err := bank.Goods.New(driver.ID(), "ride", wallets.NewMoney(wallets.DefaultCurrency, 100))
+	if err != nil {
+		t.Fatalf("failed to add goods: %v", err)
+	}
+	passenger, _ := newUser(t, bank, "27810000000", "passenger", "1234")
+	s, err := bank.Sessions.New(passenger.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+
+	if code, body := do(http.MethodPost, "/session/pay/goods/"+g.ID(), s.ID(), "", ""); code != http.StatusUnprocessableEntity {
+		t.Fatalf("pay without funds: %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/session/deposit", admin.ID(), "dep-1", `{"msisdn":"27810000000","amount":"1.00"}`); code != http.StatusOK {
+		t.Fatalf("failed to deposit: %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/session/deposit", admin.ID(), "dep-1", `{"msisdn":"27810000000","amount":"2.00"}`); code != http.StatusConflict {
+		t.Fatalf("reused idempotency key: %d %s", code, body)
+	}
+	if code, body := do(http.MethodPost, "/session/deposit", s.ID(), "", `{"msisdn":"27810000000","amount":"1.00"}`); code != http.StatusForbidden {
+		t.Fatalf("passenger deposit: %d %s", code, body)
+	}
+}
+
+//TestReverseCurrency refunds part of a payment made in a currency
+//without minor units
+func TestReverseCurrency(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	bank := newBank(t)
+	handler := router(bank)
+
+	driver, err := bank.Users.New("27800000000", "driver", "0000")
+	if err != nil {
+		t.Fatalf("failed to create driver: %v", err)
+	}
+	driverWallet, err := bank.Wallets.New(driver, "yen", wallets.NewMoney("JPY", 0))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	passenger, err := bank.Users.New("27810000000", "passenger", "1234")
+	if err != nil {
+		t.Fatalf("failed to create passenger: %v", err)
+	}
+	passengerWallet, err := bank.Wallets.New(passenger, "yen", wallets.NewMoney("JPY", -1000))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	s, err := bank.Sessions.New(passenger.ID(), "1234", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	paid, err := bank.Send(s, passengerWallet, driverWallet, wallets.NewMoney("JPY", 500), "ride", "")
+	if err != nil {
+		t.Fatalf("failed to pay: %v", err)
+	}
+	ds, err := bank.Sessions.New(driver.ID(), "0000", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/session/reverse/"+paid.ID(), strings.NewReader(`{"reason":"short ride","amount":"200"}`))
+	req.Header.Set("Authorization", "Bearer "+ds.ID())
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("failed to refund: %d %s", res.Code, res.Body.String())
+	}
+	if driverWallet.Balance() != wallets.NewMoney("JPY", 300) || passengerWallet.Balance() != wallets.NewMoney("JPY", -300) {
+		t.Fatalf("wrong balances %s %s", driverWallet.Balance(), passengerWallet.Balance())
+	}
+}
+
+func TestConvert(t *testing.T) {
+	users.PasswordCost = bcrypt.MinCost
+	config := ledger.DefaultConfig()
+	config.AdminMsisdn = "27824526299"
+	config.Backends = ledger.AllBackends("memory")
+	bank := ledger.New(config)
+	fx := []wallets.Money{wallets.NewMoney(wallets.DefaultCurrency, -100000), wallets.NewMoney("BWP", -100000)}
+	if err := bank.Setup(config.AdminMsisdn, "admin", "admin", wallets.NewMoney(wallets.DefaultCurrency, -100000000), fx); err != nil {
+		t.Fatalf("Failed to setup bank: %v", err)
+	}
+	handler := router(bank)
+
+	teller, err := bank.Users.New("27800000000", "teller", "0000")
+	if err != nil {
+		t.Fatalf("failed to create teller: %v", err)
+	}
+	zarWallet, err := bank.Wallets.New(teller, "default", wallets.NewMoney(wallets.DefaultCurrency, -10000))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	bwpWallet, err := bank.Wallets.New(teller, "bwp", wallets.NewMoney("BWP", 0))
+	if err != nil {
+		t.Fatalf("failed to create wallet: %v", err)
+	}
+	s, err := bank.Sessions.New(teller.ID(), "0000", sessions.Client{})
+	if err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+
+	convert := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/session/convert", strings.NewReader(`{"from":"default","to":"bwp","amount":"100.00","rate":"0.78","reference":"border"}`))
+		req.Header.Set("Authorization", "Bearer "+s.ID())
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	if code := convert(); code != http.StatusForbidden {
+		t.Fatalf("passenger converted: %d", code)
+	}
+	if err := teller.SetRoles(users.RoleTeller); err != nil {
+		t.Fatalf("failed to set roles: %v", err)
+	}
+	if code := convert(); code != http.StatusOK {
+		t.Fatalf("failed to convert: %d", code)
+	}
+	if zarWallet.Balance() != wallets.NewMoney(wallets.DefaultCurrency, -10000) || bwpWallet.Balance() != wallets.NewMoney("BWP", 7800) {
+		t.Fatalf("wrong balances %s %s", zarWallet.Balance(), bwpWallet.Balance())
+	}
+}
@@ -1,51 +1,55 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/ledger"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
 	"github.com/jansemmelink/taxiching/lib/wallets"
 )
 
 type sessionData struct {
-	SID     string            `json:"session-id,omitempty"`
-	UID     string            `json:"user-id,omitempty"`
-	Expiry  string            `json:"expiry,omitempty"`
-	Balance int               `json:"balance,omitempty"`
-	Recent  []transactionData `json:"recent"`
-	Goods   []goodsData       `json:"goods"`
+	SID      string            `json:"session-id,omitempty"`
+	UID      string            `json:"user-id,omitempty"`
+	Expiry   string            `json:"expiry,omitempty"`
+	Balance  *wallets.Money    `json:"balance,omitempty"`
+	Currency wallets.Currency  `json:"currency,omitempty"`
+	Recent   []transactionData `json:"recent"`
+	Goods    []goodsData       `json:"goods"`
 }
 
 type transactionData struct {
 	Error string `json:"error,omitempty"`
 
-	ID          string         `json:"id,omitempty"`
-	Time        string         `json:"time,omitempty"`
-	Description string         `json:"description,omitempty"`
-	Reference   string         `json:"reference,omitempty"`
-	Amount      wallets.Amount `json:"amount,omitempty"`
+	ID          string           `json:"id,omitempty"`
+	Time        string           `json:"time,omitempty"`
+	Description string           `json:"description,omitempty"`
+	Reference   string           `json:"reference,omitempty"`
+	Currency    wallets.Currency `json:"currency,omitempty"`
+	Amount      wallets.Money    `json:"amount"`
 
-	NewBalance wallets.Amount `json:"newBalance,omitempty"`
+	NewBalance wallets.Money `json:"newBalance"`
 }
 
 type goodsData struct {
 	ID   string
 	Name string
-	Cost wallets.Amount
+	Cost wallets.Money //in the default currency
 }
 
-//r.Get("/session/{id}/ministatement", SessionMiniStatement)
+//r.Get("/session[/{id}]/ministatement", SessionMiniStatement)
 func SessionMiniStatement(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
-		return
-	}
+	s := requestSession(req)
 	w := bank.Wallets.UserWallet(s.User().ID(), "default")
 	if w == nil {
 		http.Error(res, "Failed to get user wallet", http.StatusInternalServerError)
@@ -54,53 +58,176 @@ func SessionMiniStatement(res http.ResponseWriter, req *http.Request, bank *ledg
 
 	//output
 	sd := sessionData{
-		SID:     s.ID(),
-		Expiry:  s.Expire().Format(timeFormat),
-		UID:     s.User().ID(),
-		Balance: int(w.Balance()),
-		Recent:  make([]transactionData, 0),
-	}
-
-	transactions := ledger.All()
-	for _, t := range transactions {
-		if t.DebitWallet().ID() == w.ID() || t.CreditWallet().ID() == w.ID() {
-			sd.Recent = append(sd.Recent, transactionData{
-				ID:          t.ID(),
-				Time:        t.Timestamp().Format(timeFormat),
-				Description: t.Description(),
-				Reference:   t.Reference(),
-				Amount:      t.Amount(),
-			})
-		}
+		SID:      s.ID(),
+		Expiry:   s.Expire().Format(timeFormat),
+		UID:      s.User().ID(),
+		Balance:  balance(w),
+		Currency: w.Currency(),
+		Recent:   make([]transactionData, 0),
+	}
+
+	//debits are shown as negative amounts so each line's
+	//amount adds up to its running balance
+	lines, err := bank.MiniStatement(w.ID())
+	if err != nil {
+		http.Error(res, "Failed to get transactions", http.StatusInternalServerError)
+		return
+	}
+	for _, l := range lines {
+		sd.Recent = append(sd.Recent, transactionData{
+			ID:          l.Transaction.ID(),
+			Time:        l.Transaction.Timestamp().Format(timeFormat),
+			Description: l.Transaction.Description(),
+			Reference:   l.Transaction.Reference(),
+			Currency:    l.Amount.Currency,
+			Amount:      l.Amount,
+			NewBalance:  l.Balance,
+		})
 	}
 
 	j, _ := json.Marshal(sd)
 	res.Write(j)
 }
 
-//r.Delete("/session/{id}/goods/{goodsid}", SessionGoodsDel)
-func SessionGoodsDel(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
+//balance returns the wallet balance to show in sessionData
+func balance(w wallets.IWallet) *wallets.Money {
+	b := w.Balance()
+	return &b
+}
+
+type statementData struct {
+	WalletID       string            `json:"wallet-id"`
+	Currency       wallets.Currency  `json:"currency"`
+	From           string            `json:"from"`
+	To             string            `json:"to"`
+	OpeningBalance wallets.Money     `json:"openingBalance"`
+	ClosingBalance wallets.Money     `json:"closingBalance"`
+	Lines          []transactionData `json:"lines"`
+	Next           string            `json:"next,omitempty"`
+}
+
+//r.Get("/session[/{id}]/statement", SessionStatement)
+//query: from=<date>&to=<date>&limit=<n>&cursor=<next>&format=csv
+//dates are YYYY-MM-DD (to is inclusive) or RFC3339 times
+func SessionStatement(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+	w := bank.Wallets.UserWallet(s.User().ID(), "default")
+	if w == nil {
+		http.Error(res, "Failed to get user wallet", http.StatusInternalServerError)
 		return
 	}
 
+	q := req.URL.Query()
+	from := time.Time{}
+	to := time.Now()
+	var err error
+	if v := q.Get("from"); len(v) > 0 {
+		if from, err = parseStatementTime(v, false); err != nil {
+			http.Error(res, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); len(v) > 0 {
+		if to, err = parseStatementTime(v, true); err != nil {
+			http.Error(res, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if v := q.Get("limit"); len(v) > 0 {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(res, "invalid limit="+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	st, err := bank.Statement(w.ID(), from, to, q.Get("cursor"), limit)
+	if err != nil {
+		http.Error(res, "Failed to get statement: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		writeStatementCSV(res, st)
+		return
+	}
+
+	sd := statementData{
+		WalletID:       w.ID(),
+		Currency:       w.Currency(),
+		From:           st.From.Format(timeFormat),
+		To:             st.To.Format(timeFormat),
+		OpeningBalance: st.OpeningBalance,
+		ClosingBalance: st.ClosingBalance,
+		Lines:          make([]transactionData, 0, len(st.Lines)),
+		Next:           st.Next,
+	}
+	for _, l := range st.Lines {
+		sd.Lines = append(sd.Lines, transactionData{
+			ID:          l.Transaction.ID(),
+			Time:        l.Transaction.Timestamp().Format(timeFormat),
+			Description: l.Transaction.Description(),
+			Reference:   l.Transaction.Reference(),
+			Currency:    l.Amount.Currency,
+			Amount:      l.Amount,
+			NewBalance:  l.Balance,
+		})
+	}
+	j, _ := json.Marshal(sd)
+	res.Write(j)
+} //SessionStatement()
+
+//parseStatementTime parses a date or RFC3339 time
+//a date at the end of the range includes the whole day
+func parseStatementTime(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		if end {
+			t = t.Add(24 * time.Hour)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+} //parseStatementTime()
+
+func writeStatementCSV(res http.ResponseWriter, st ledger.Statement) {
+	res.Header().Set("Content-Type", "text/csv")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"statement-%s.csv\"", st.From.Format("20060102")))
+	cw := csv.NewWriter(res)
+	cw.Write([]string{"time", "id", "description", "reference", "amount", "balance"})
+	cw.Write([]string{st.From.Format(timeFormat), "", "opening balance", "", "", st.OpeningBalance.Decimal()})
+	for _, l := range st.Lines {
+		cw.Write([]string{
+			l.Transaction.Timestamp().Format(timeFormat),
+			l.Transaction.ID(),
+			l.Transaction.Description(),
+			l.Transaction.Reference(),
+			l.Amount.Decimal(),
+			l.Balance.Decimal(),
+		})
+	}
+	cw.Write([]string{st.To.Format(timeFormat), "", "closing balance", "", "", st.ClosingBalance.Decimal()})
+	cw.Flush()
+} //writeStatementCSV()
+
+//r.Delete("/session[/{id}]/goods/{goodsid}", SessionGoodsDel)
+func SessionGoodsDel(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+
 	goodsID := req.URL.Query().Get(":goodsid")
-	bank.Goods.DelID(goodsID)
+	g := bank.Goods.GetID(goodsID)
+	if g == nil || g.Owner().ID() != s.User().ID() {
+		http.Error(res, "Unknown goods id", http.StatusNotFound)
+		return
+	}
+	if !bank.Goods.DelID(goodsID) {
+		http.Error(res, "Unknown goods id", http.StatusNotFound)
+		return
+	}
 }
 
-//r.Get("/session/{id}/goods", SessionGoodsList)
+//r.Get("/session[/{id}]/goods", SessionGoodsList)
 func SessionGoodsList(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
-		return
-	}
+	s := requestSession(req)
 
 	//output
 	sd := sessionData{
@@ -124,15 +251,9 @@ func SessionGoodsList(res http.ResponseWriter, req *http.Request, bank *ledger.B
 	res.Write(j)
 } //SessionGoodsList()
 
-//r.Post("/session/{id}/goods", SessionGoodsAdd)
+//r.Post("/session[/{id}]/goods", SessionGoodsAdd)
 func SessionGoodsAdd(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
-		return
-	}
+	s := requestSession(req)
 
 	//parse request
 	var gd goodsData
@@ -148,8 +269,8 @@ func SessionGoodsAdd(res http.ResponseWriter, req *http.Request, bank *ledger.Ba
 		http.Error(res, "missing name", http.StatusBadRequest)
 		return
 	}
-	if gd.Cost <= 0 {
-		http.Error(res, fmt.Sprintf("invalid cost=%d", gd.Cost), http.StatusBadRequest)
+	if !gd.Cost.IsPositive() {
+		http.Error(res, fmt.Sprintf("invalid cost=%s", gd.Cost.Decimal()), http.StatusBadRequest)
 		return
 	}
 
@@ -168,15 +289,9 @@ func SessionGoodsAdd(res http.ResponseWriter, req *http.Request, bank *ledger.Ba
 	res.Write(j)
 }
 
-//r.Get("/session/{id}/keepalive", SessionKeepAlive)
+//r.Get("/session[/{id}]/keepalive", SessionKeepAlive)
 func SessionKeepAlive(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
-		return
-	}
+	s := requestSession(req)
 
 	s.Extend()
 
@@ -192,15 +307,13 @@ func SessionKeepAlive(res http.ResponseWriter, req *http.Request, bank *ledger.B
 	res.Write(j)
 }
 
-//r.Post("/session/{id}/pay/goods/{goodsid}", SessionPayGoods)
+//idempotencyKeyHeader is an optional request header with a client
+//generated key, so a retry of the same payment does not pay again
+const idempotencyKeyHeader = "Idempotency-Key"
+
+//r.Post("/session[/{id}]/pay/goods/{goodsid}", SessionPayGoods)
 func SessionPayGoods(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
-		return
-	}
+	s := requestSession(req)
 	goodsID := req.URL.Query().Get(":goodsid")
 	g := bank.Goods.GetID(goodsID)
 	if g == nil {
@@ -213,10 +326,7 @@ func SessionPayGoods(res http.ResponseWriter, req *http.Request, bank *ledger.Ba
 		return
 	}
 	td := transactionData{}
-	if buyerWallet.Balance() < g.Cost() {
-		http.Error(res, "Insufficient funds", http.StatusNotAcceptable)
-		return
-	}
+	key := req.Header.Get(idempotencyKeyHeader)
 
 	//wallet of seller
 	seller := g.Owner()
@@ -231,15 +341,16 @@ func SessionPayGoods(res http.ResponseWriter, req *http.Request, bank *ledger.Ba
 	}
 
 	ref := fmt.Sprintf("%s buy %s", s.User().Name(), g.Name())
-	t, err := bank.Send(s, buyerWallet, sellerWallet, g.Cost(), ref)
+	t, err := bank.Send(s, buyerWallet, sellerWallet, g.Cost(), ref, key)
 	if err != nil {
-		http.Error(res, "Failed to transact: "+err.Error(), http.StatusInternalServerError)
+		ledgerError(res, "Failed to transact", err, http.StatusInternalServerError)
 		return
 	}
 
 	td.ID = t.ID()
 	td.Time = t.Timestamp().Format(timeFormat)
 	td.Description = t.Reference()
+	td.Currency = t.Amount().Currency
 	td.Amount = t.Amount()
 	td.NewBalance = buyerWallet.Balance()
 
@@ -249,23 +360,92 @@ func SessionPayGoods(res http.ResponseWriter, req *http.Request, bank *ledger.Ba
 }
 
 type depositRequest struct {
-	Msisdn string         `json:"msisdn"`
-	Amount wallets.Amount `json:"amount"`
+	Msisdn string        `json:"msisdn"`
+	Amount wallets.Money `json:"amount"` //in the default currency
 }
 
-//r.Post("/session/{id}/deposit", SessionDeposit)
-func SessionDeposit(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	s := bank.Sessions.GetID(sessionID)
-	if s == nil {
-		http.Error(res, "Unknown session", http.StatusUnauthorized)
+type deviceData struct {
+	Ref       string `json:"ref"` //use to end the session, the session id is secret
+	Current   bool   `json:"current"`
+	Device    string `json:"device,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Start     string `json:"start"`
+	Expiry    string `json:"expiry"`
+}
+
+//sessionRef identifies a session in the list of devices without
+//revealing the session id
+func sessionRef(s sessions.ISession) string {
+	h := sha256.Sum256([]byte(s.ID()))
+	return hex.EncodeToString(h[:8])
+} //sessionRef()
+
+//r.Get("/session[/{id}]/devices", SessionDevices)
+func SessionDevices(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+
+	userSessions, err := bank.Sessions.UserSessions(s.User().ID())
+	if err != nil {
+		devicesError(res, err)
 		return
 	}
-	if s.User().Msisdn() != "27824526299" {
-		http.Error(res, "This function is restricted to admin user", http.StatusUnauthorized)
+	sort.Slice(userSessions, func(i, j int) bool { return userSessions[i].Start().Before(userSessions[j].Start()) })
+	list := []deviceData{}
+	for _, us := range userSessions {
+		c := us.Client()
+		list = append(list, deviceData{
+			Ref:       sessionRef(us),
+			Current:   us.ID() == s.ID(),
+			Device:    c.Device,
+			IP:        c.IP,
+			UserAgent: c.UserAgent,
+			Start:     us.Start().Format(timeFormat),
+			Expiry:    us.Expire().Format(timeFormat),
+		})
+	}
+	j, _ := json.Marshal(list)
+	res.Write(j)
+} //SessionDevices()
+
+//r.Delete("/session[/{id}]/devices/{ref}", SessionDeviceEnd)
+func SessionDeviceEnd(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+	ref := req.URL.Query().Get(":ref")
+	userSessions, err := bank.Sessions.UserSessions(s.User().ID())
+	if err != nil {
+		devicesError(res, err)
 		return
 	}
+	for _, us := range userSessions {
+		if sessionRef(us) == ref {
+			bank.Sessions.End(us.ID())
+			return
+		}
+	}
+	http.Error(res, "Unknown device ref="+ref, http.StatusNotFound)
+} //SessionDeviceEnd()
+
+//devicesError responds 501 when the session backend cannot list the
+//sessions of a user, e.g. signed tokens
+func devicesError(res http.ResponseWriter, err error) {
+	if err == sessions.ErrUnsupported {
+		http.Error(res, "Listing devices is not supported", http.StatusNotImplemented)
+		return
+	}
+	log.Errorf("Failed to get user sessions: %v", err)
+	http.Error(res, "Failed to get devices", http.StatusInternalServerError)
+} //devicesError()
+
+//r.Delete("/session[/{id}]/devices", SessionDevicesEnd)
+//ends all sessions of the user, including this one
+func SessionDevicesEnd(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	bank.Sessions.EndUser(requestSession(req).User().ID())
+} //SessionDevicesEnd()
+
+//r.Post("/session[/{id}]/deposit", SessionDeposit)
+func SessionDeposit(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
 
 	var r depositRequest
 	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
@@ -276,12 +456,16 @@ func SessionDeposit(res http.ResponseWriter, req *http.Request, bank *ledger.Ban
 		http.Error(res, "msisdn not specified", http.StatusBadRequest)
 		return
 	}
-	if r.Amount <= 0 {
+	if !r.Amount.IsPositive() {
 		http.Error(res, "amount not specified", http.StatusBadRequest)
 		return
 	}
 
-	u := bank.Users.GetMsisdn(r.Msisdn)
+	u, err := bank.Users.GetMsisdn(r.Msisdn)
+	if err != nil {
+		http.Error(res, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
 	if u == nil {
 		http.Error(res, "Unknown user msisdn="+r.Msisdn, http.StatusNotFound)
 		return
@@ -294,15 +478,16 @@ func SessionDeposit(res http.ResponseWriter, req *http.Request, bank *ledger.Ban
 
 	td := transactionData{}
 	ref := fmt.Sprintf("deposit into %s", r.Msisdn)
-	t, err := bank.Send(s, bank.BankWallet, userWallet, r.Amount, ref)
+	t, err := bank.Send(s, bank.BankWallet, userWallet, r.Amount, ref, req.Header.Get(idempotencyKeyHeader))
 	if err != nil {
-		http.Error(res, "Failed to transact: "+err.Error(), http.StatusInternalServerError)
+		ledgerError(res, "Failed to transact", err, http.StatusInternalServerError)
 		return
 	}
 
 	td.ID = t.ID()
 	td.Time = t.Timestamp().Format(timeFormat)
 	td.Description = t.Reference()
+	td.Currency = t.Amount().Currency
 	td.Amount = t.Amount()
 	td.NewBalance = userWallet.Balance()
 
@@ -313,10 +498,209 @@ func SessionDeposit(res http.ResponseWriter, req *http.Request, bank *ledger.Ban
 	return
 } //SessionDeposit()
 
-//r.Get("/session/{id}/logout", SessionLogout)
+type convertRequest struct {
+	From      string `json:"from"` //names of the user's wallets
+	To        string `json:"to"`
+	Amount    string `json:"amount"` //in the currency of the from wallet
+	Rate      string `json:"rate"`   //units of the to currency per unit of the from currency
+	Reference string `json:"reference"`
+}
+
+//r.Post("/session[/{id}]/convert", SessionConvert)
+func SessionConvert(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+
+	var r convertRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from := bank.Wallets.UserWallet(s.User().ID(), r.From)
+	if from == nil {
+		http.Error(res, "Unknown wallet "+r.From, http.StatusNotFound)
+		return
+	}
+	to := bank.Wallets.UserWallet(s.User().ID(), r.To)
+	if to == nil {
+		http.Error(res, "Unknown wallet "+r.To, http.StatusNotFound)
+		return
+	}
+	amount, err := wallets.ParseMoney(from.Currency(), r.Amount)
+	if err != nil {
+		http.Error(res, "invalid amount: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	list, err := bank.Convert(s, from, to, amount, r.Rate, r.Reference)
+	if err != nil {
+		ledgerError(res, "Failed to convert", err, http.StatusBadRequest)
+		return
+	}
+
+	//the debit of the from wallet and the credit of the to wallet
+	tds := []transactionData{
+		{NewBalance: list[0].DebitBalanceAfter()},
+		{NewBalance: list[1].CreditBalanceAfter()},
+	}
+	for i, t := range list {
+		tds[i].ID = t.ID()
+		tds[i].Time = t.Timestamp().Format(timeFormat)
+		tds[i].Description = t.Reference()
+		tds[i].Currency = t.Amount().Currency
+		tds[i].Amount = t.Amount()
+	}
+	j, _ := json.Marshal(tds)
+	log.Debugf("transactionData: %s", string(j))
+	res.Write(j)
+} //SessionConvert()
+
+//r.Post("/session[/{id}]/admin/unlock/{userid}", SessionUnlockUser)
+func SessionUnlockUser(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+
+	userID := req.URL.Query().Get(":userid")
+	if !bank.Sessions.Unlock(userID, "user.id="+s.User().ID()) {
+		http.Error(res, "No failed logins for user.id="+userID, http.StatusNotFound)
+		return
+	}
+} //SessionUnlockUser()
+
+type rolesRequest struct {
+	Roles []users.Role `json:"roles"`
+}
+
+//r.Post("/session[/{id}]/admin/roles/{userid}", SessionSetRoles)
+//replaces the roles of the user, e.g. {"roles":["driver"]}
+func SessionSetRoles(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	var r rolesRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	userID := req.URL.Query().Get(":userid")
+	if u, err := bank.Users.GetID(userID); err != nil {
+		http.Error(res, "Failed to get user", http.StatusInternalServerError)
+		return
+	} else if u == nil {
+		http.Error(res, "Unknown user.id="+userID, http.StatusNotFound)
+		return
+	}
+	u, err := bank.SetRoles(requestSession(req), userID, r.Roles...)
+	if err != nil {
+		http.Error(res, "Failed to set roles: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	audit("ROLES", "user.id=%s roles=%v by user.id=%s", u.ID(), u.Roles(), requestSession(req).User().ID())
+
+	j, _ := json.Marshal(userData{
+		ID:     u.ID(),
+		Msisdn: u.Msisdn(),
+		Name:   u.Name(),
+		Roles:  u.Roles(),
+	})
+	res.Write(j)
+} //SessionSetRoles()
+
+type verifyData struct {
+	OK bool `json:"ok"`
+	ledger.VerifyReport
+}
+
+//r.Get("/session[/{id}]/admin/verify", SessionVerify)
+//responds with 409 Conflict when the ledger does not balance so that a
+//nightly check can alert on the status alone
+func SessionVerify(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	report, err := bank.Verify()
+	if err != nil {
+		http.Error(res, "Failed to verify: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !report.OK() {
+		log.Errorf("Ledger verify failed: %d discrepancies, %d below min balance, %d errors", len(report.Discrepancies), len(report.BelowMinBalance), len(report.Errors))
+	}
+
+	j, _ := json.Marshal(verifyData{OK: report.OK(), VerifyReport: report})
+	if !report.OK() {
+		res.WriteHeader(http.StatusConflict)
+	}
+	res.Write(j)
+} //SessionVerify()
+
+type reverseRequest struct {
+	Reason string        `json:"reason"`
+	Amount wallets.Money `json:"amount,omitempty"` //partial refund, default is all that remains
+}
+
+//r.Post("/session[/{id}]/reverse/{txid}", SessionReverse)
+func SessionReverse(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+	s := requestSession(req)
+	txID := req.URL.Query().Get(":txid")
+	original := bank.Transactions.GetID(txID)
+	if original == nil {
+		http.Error(res, "Unknown transaction id", http.StatusNotFound)
+		return
+	}
+
+	//the amount is in the currency of the original transaction
+	r := reverseRequest{Amount: wallets.NewMoney(original.Amount().Currency, 0)}
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(r.Reason) == 0 {
+		http.Error(res, "reason not specified", http.StatusBadRequest)
+		return
+	}
+	if r.Amount.IsNegative() {
+		http.Error(res, "invalid amount", http.StatusBadRequest)
+		return
+	}
+
+	var t ledger.ITransaction
+	var err error
+	if r.Amount.IsPositive() {
+		t, err = bank.Refund(s, txID, r.Amount, r.Reason)
+	} else {
+		t, err = bank.Reverse(s, txID, r.Reason)
+	}
+	if err != nil {
+		ledgerError(res, "Failed to reverse", err, http.StatusBadRequest)
+		return
+	}
+
+	td := transactionData{
+		ID:          t.ID(),
+		Time:        t.Timestamp().Format(timeFormat),
+		Description: t.Reference(),
+		Currency:    t.Amount().Currency,
+		Amount:      t.Amount(),
+		NewBalance:  t.DebitBalanceAfter(),
+	}
+	j, _ := json.Marshal(td)
+	log.Debugf("transactionData: %s", string(j))
+	res.Write(j)
+} //SessionReverse()
+
+//ledgerError writes the status for a refused ledger request, or status
+//for any other error
+func ledgerError(res http.ResponseWriter, msg string, err error, status int) {
+	if e, ok := err.(*ledger.Error); ok {
+		switch e.Kind {
+		case ledger.ErrSession:
+			status = http.StatusUnauthorized
+		case ledger.ErrPermission:
+			status = http.StatusForbidden
+		case ledger.ErrFunds:
+			status = http.StatusUnprocessableEntity
+		case ledger.ErrConflict:
+			status = http.StatusConflict
+		}
+	}
+	http.Error(res, msg+": "+err.Error(), status)
+} //ledgerError()
+
+//r.Get("/session[/{id}]/logout", SessionLogout)
 func SessionLogout(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
-	log.Debugf("%s %s", req.Method, req.URL.Path)
-	sessionID := req.URL.Query().Get(":id")
-	bank.Sessions.End(sessionID)
+	bank.Sessions.End(requestSession(req).ID())
 	return
 }
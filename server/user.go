@@ -2,17 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/jansemmelink/log"
 	"github.com/jansemmelink/taxiching/lib/ledger"
+	"github.com/jansemmelink/taxiching/lib/sessions"
+	"github.com/jansemmelink/taxiching/lib/users"
+	"github.com/jansemmelink/taxiching/lib/wallets"
 )
 
 type userData struct {
-	ID     string `json:"user-id,omitempty"`
-	Msisdn string `json:"msisdn"`
-	Name   string `json:"name"`
-	Pin    string `json:"pin,omitempty"`
+	ID     string       `json:"user-id,omitempty"`
+	Msisdn string       `json:"msisdn"`
+	Name   string       `json:"name"`
+	Pin    string       `json:"pin,omitempty"`
+	Roles  []users.Role `json:"roles,omitempty"`
 }
 
 func UserAdd(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
@@ -46,7 +53,7 @@ func UserAdd(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
 		return
 	}
 
-	userDefaultWallet, err := bank.Wallets.New(user, "default", 0)
+	userDefaultWallet, err := bank.Wallets.New(user, "default", wallets.NewMoney(wallets.DefaultCurrency, 0))
 	if err != nil {
 		http.Error(res, "failed to create user wallet: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -66,7 +73,11 @@ func UserGetID(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
 		http.Error(res, "expecting /user/<id>", http.StatusBadRequest)
 		return
 	}
-	user := bank.Users.GetID(id)
+	user, err := bank.Users.GetID(id)
+	if err != nil {
+		http.Error(res, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
 	if user == nil {
 		http.Error(res, "user "+id+" does not exist", http.StatusNotFound)
 		return
@@ -88,7 +99,11 @@ func UserGetMsisdn(res http.ResponseWriter, req *http.Request, bank *ledger.Bank
 		http.Error(res, "expecting /user/msisdn/<msisdn>", http.StatusBadRequest)
 		return
 	}
-	user := bank.Users.GetMsisdn(msisdn)
+	user, err := bank.Users.GetMsisdn(msisdn)
+	if err != nil {
+		http.Error(res, "Failed to get user", http.StatusInternalServerError)
+		return
+	}
 	if user == nil {
 		http.Error(res, "user "+msisdn+" does not exist", http.StatusNotFound)
 		return
@@ -103,25 +118,152 @@ func UserGetMsisdn(res http.ResponseWriter, req *http.Request, bank *ledger.Bank
 	res.Write(j)
 } //UserGetMsisdn()
 
-func UserLogin(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
+//deprecatedGetLogin enables GET /user/{id}/login/{pin}, which puts the
+//pin in proxy logs and browser history, use POST /login instead
+var deprecatedGetLogin = false
+
+type loginRequest struct {
+	UserID string `json:"user-id,omitempty"`
+	Msisdn string `json:"msisdn,omitempty"`
+	Pin    string `json:"pin"`
+	Device string `json:"device,omitempty"` //label shown in the list of devices
+}
+
+//r.Post("/login", Login)
+//body has the pin with either the user-id or msisdn
+func Login(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
 	log.Debugf("%s %s", req.Method, req.URL.Path)
+	var r loginRequest
+	if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+		http.Error(res, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(r.Pin) == 0 || (len(r.UserID) == 0) == (len(r.Msisdn) == 0) {
+		http.Error(res, "Login with {\"user-id\" or \"msisdn\", \"pin\"}", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.UserID
+	if len(r.Msisdn) > 0 {
+		//unknown msisdn still counts as a failed login for the msisdn
+		userID = r.Msisdn
+		u, err := bank.Users.GetMsisdn(r.Msisdn)
+		if err != nil {
+			loginError(res, &sessions.UsersError{Err: err})
+			return
+		}
+		if u != nil {
+			userID = u.ID()
+		}
+	}
+	login(res, req, bank, userID, r.Pin, r.Device)
+} //Login()
+
+//r.Get("/user/{id}/login/{pin}", UserLogin)
+//deprecated, only registered when deprecatedGetLogin is set
+func UserLogin(res http.ResponseWriter, req *http.Request, bank *ledger.Bank) {
 	userID := req.URL.Query().Get(":id")
+	log.Debugf("%s /user/%s/login/****", req.Method, userID) //never log the pin
+	log.Errorf("Deprecated GET login used for user.id=%s, use POST /login", userID)
+	res.Header().Set("Deprecation", "true")
 	pin := req.URL.Query().Get(":pin")
 	if len(userID) == 0 || len(pin) == 0 {
 		http.Error(res, "Login with /user/<id>/login/<pin>", http.StatusBadRequest)
 		return
 	}
-	session, err := bank.Sessions.New(userID, pin)
+	login(res, req, bank, userID, pin, "")
+} //UserLogin()
+
+func login(res http.ResponseWriter, req *http.Request, bank *ledger.Bank, userID string, pin string, device string) {
+	client := sessions.Client{
+		Device:    device,
+		IP:        clientIP(req),
+		UserAgent: req.UserAgent(),
+	}
+	session, err := bank.Sessions.New(userID, pin, client)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusUnauthorized)
+		loginError(res, err)
 		return
 	}
 
 	s := sessionData{
 		SID:    session.ID(),
-		UID:    userID,
+		UID:    session.User().ID(),
 		Expiry: session.Expire().Format(timeFormat),
 	}
 	j, _ := json.Marshal(s)
 	res.Write(j)
-} //UserLogin()
+} //login()
+
+//loginError responds to a failed login
+//423 Locked when an admin must unlock the user, 429 when the client must
+//wait before trying again, 503 when the login could not be checked
+func loginError(res http.ResponseWriter, err error) {
+	if _, ok := err.(*sessions.UsersError); ok {
+		log.Errorf("Login failed: %v", err)
+		http.Error(res, "Cannot login now, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if le, ok := err.(*sessions.LoginError); ok {
+		if le.Locked {
+			http.Error(res, le.Error(), http.StatusLocked)
+			return
+		}
+		res.Header().Set("Retry-After", fmt.Sprintf("%d", int(le.RetryAfter.Seconds()+1)))
+		http.Error(res, le.Error(), http.StatusTooManyRequests)
+		return
+	}
+	http.Error(res, err.Error(), http.StatusUnauthorized)
+} //loginError()
+
+//trustedProxies are the networks of reverse proxies that add the client
+//address to X-Forwarded-For, the header is ignored from other addresses
+var trustedProxies []*net.IPNet
+
+//parseProxies parses IP addresses and CIDR networks, e.g. "10.0.0.0/8"
+func parseProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, log.Wrapf(err, "invalid trusted proxy \"%s\"", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+} //parseProxies()
+
+func trusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range trustedProxies {
+		if addr != nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+} //trusted()
+
+//clientIP is the address the request came from, without the port
+//behind trusted proxies, it is the last address in X-Forwarded-For that
+//was not added by a trusted proxy, as clients can write anything before it
+func clientIP(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trusted(ip); i-- {
+		if f := strings.TrimSpace(forwarded[i]); len(f) > 0 {
+			ip = f
+		}
+	}
+	return ip
+} //clientIP()